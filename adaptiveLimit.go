@@ -0,0 +1,191 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// AdaptiveLimitOptions configures an AdaptiveLimiter. Zero values fall back
+// to the documented defaults.
+type AdaptiveLimitOptions struct {
+	// InitialLimit is the concurrency limit to start with. Defaults to 10.
+	InitialLimit int
+
+	// MinLimit and MaxLimit bound the concurrency limit. Default to 1 and 1000.
+	MinLimit int
+	MaxLimit int
+
+	// LatencyTolerance is how many times slower than the long-term average
+	// latency a response can be before it's considered a sign of overload.
+	// Defaults to 2.
+	LatencyTolerance float64
+
+	// Backoff is the ratio the limit is multiplied by on overload.
+	// Defaults to 0.9.
+	Backoff float64
+
+	// IsOverload reports whether a response or error is a sign of overload.
+	// Defaults to 429 and 503 responses and timeouts.
+	IsOverload func(resp *http.Response, err error) bool
+}
+
+// AdaptiveLimiter limits the number of requests in flight, adapting the
+// limit to the observed latency and errors (AIMD). The limit grows by one
+// while the upstream keeps up and it's cut multiplicatively when latency
+// rises or the upstream responds with 429 or 503. Use its Transport method
+// as a middleware:
+//
+//	limiter := transport.NewAdaptiveLimiter(transport.AdaptiveLimitOptions{})
+//
+//	client := &http.Client{
+//	    Transport: transport.Chain(http.DefaultTransport, limiter.Transport),
+//	}
+//
+// Like with MaxInFlight, a slot is released once the response body is closed.
+type AdaptiveLimiter struct {
+	opts AdaptiveLimitOptions
+
+	mu       sync.Mutex
+	limit    float64
+	inFlight int
+	released chan struct{} // closed and replaced whenever a slot is released
+	avgRTT   float64       // exponentially weighted moving average, in seconds
+}
+
+// NewAdaptiveLimiter creates an AdaptiveLimiter.
+func NewAdaptiveLimiter(opts AdaptiveLimitOptions) *AdaptiveLimiter {
+	if opts.MinLimit <= 0 {
+		opts.MinLimit = 1
+	}
+	if opts.MaxLimit <= 0 {
+		opts.MaxLimit = 1000
+	}
+	if opts.MaxLimit < opts.MinLimit {
+		opts.MaxLimit = opts.MinLimit
+	}
+	if opts.InitialLimit <= 0 {
+		opts.InitialLimit = 10
+	}
+	if opts.LatencyTolerance <= 1 {
+		opts.LatencyTolerance = 2
+	}
+	if opts.Backoff <= 0 || opts.Backoff >= 1 {
+		opts.Backoff = 0.9
+	}
+	if opts.IsOverload == nil {
+		opts.IsOverload = isOverload
+	}
+
+	l := &AdaptiveLimiter{
+		opts:     opts,
+		released: make(chan struct{}),
+	}
+	l.limit = l.clamp(float64(opts.InitialLimit))
+	return l
+}
+
+func isOverload(resp *http.Response, err error) bool {
+	if err != nil {
+		var netErr interface{ Timeout() bool }
+		return errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout())
+	}
+	return resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable
+}
+
+// Limit returns the current concurrency limit.
+func (l *AdaptiveLimiter) Limit() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return int(l.limit)
+}
+
+// InFlight returns the number of requests in flight.
+func (l *AdaptiveLimiter) InFlight() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.inFlight
+}
+
+// Transport is the adaptive limiter middleware.
+func (l *AdaptiveLimiter) Transport(next http.RoundTripper) http.RoundTripper {
+	return RoundTripFunc(func(req *http.Request) (*http.Response, error) {
+		if err := l.acquire(req.Context()); err != nil {
+			return nil, err
+		}
+
+		startTime := time.Now()
+		resp, err := next.RoundTrip(req)
+
+		// The caller gave up, it says nothing about the upstream.
+		if req.Context().Err() == nil {
+			l.observe(time.Since(startTime), l.opts.IsOverload(resp, err))
+		}
+
+		if err != nil || resp.Body == nil {
+			l.release()
+			return resp, err
+		}
+
+		resp.Body = onClose(resp.Body, l.release)
+		return resp, nil
+	})
+}
+
+func (l *AdaptiveLimiter) acquire(ctx context.Context) error {
+	for {
+		l.mu.Lock()
+		if l.inFlight < int(l.limit) {
+			l.inFlight++
+			l.mu.Unlock()
+			return nil
+		}
+		released := l.released
+		l.mu.Unlock()
+
+		select {
+		case <-released:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (l *AdaptiveLimiter) release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.inFlight--
+	close(l.released)
+	l.released = make(chan struct{})
+}
+
+// observe adapts the limit to a request outcome.
+func (l *AdaptiveLimiter) observe(latency time.Duration, overload bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	rtt := latency.Seconds()
+	if l.avgRTT == 0 {
+		l.avgRTT = rtt
+	}
+	slow := rtt > l.avgRTT*l.opts.LatencyTolerance
+	l.avgRTT = 0.95*l.avgRTT + 0.05*rtt
+
+	switch {
+	case overload || slow:
+		l.limit = l.clamp(math.Floor(l.limit * l.opts.Backoff))
+	case l.inFlight*2 >= int(l.limit):
+		// Only grow the limit when it's being used.
+		l.limit = l.clamp(l.limit + 1)
+	}
+}
+
+func (l *AdaptiveLimiter) clamp(limit float64) float64 {
+	return math.Max(float64(l.opts.MinLimit), math.Min(float64(l.opts.MaxLimit), limit))
+}
@@ -0,0 +1,107 @@
+package transport_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-chi/transport"
+)
+
+func TestAdaptiveLimiter(t *testing.T) {
+	var overloaded int32 = 1
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&overloaded) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintf(w, "ok")
+	}))
+	defer server.Close()
+
+	limiter := transport.NewAdaptiveLimiter(transport.AdaptiveLimitOptions{
+		InitialLimit: 4,
+		MinLimit:     1,
+		Backoff:      0.5,
+
+		// Don't let latency jitter in tests affect the limit.
+		LatencyTolerance: 1000,
+	})
+	client := &http.Client{
+		Transport: transport.Chain(http.DefaultTransport, limiter.Transport),
+	}
+
+	get := func() {
+		resp, err := client.Get(server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+
+	for i := 0; i < 3; i++ {
+		get()
+	}
+	if limit := limiter.Limit(); limit != 1 {
+		t.Fatalf("expected limit to drop to 1 on 503s, got %v", limit)
+	}
+
+	atomic.StoreInt32(&overloaded, 0)
+	for i := 0; i < 3; i++ {
+		get()
+	}
+	if limit := limiter.Limit(); limit <= 1 {
+		t.Fatalf("expected limit to grow, got %v", limit)
+	}
+	if inFlight := limiter.InFlight(); inFlight != 0 {
+		t.Fatalf("expected no requests in flight, got %v", inFlight)
+	}
+}
+
+func TestAdaptiveLimiterLatency(t *testing.T) {
+	var slow int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&slow) == 1 {
+			time.Sleep(50 * time.Millisecond)
+		}
+		fmt.Fprintf(w, "ok")
+	}))
+	defer server.Close()
+
+	limiter := transport.NewAdaptiveLimiter(transport.AdaptiveLimitOptions{
+		InitialLimit:     8,
+		Backoff:          0.5,
+		LatencyTolerance: 20, // Tolerate jitter of fast responses.
+	})
+	client := &http.Client{
+		Transport: transport.Chain(http.DefaultTransport, limiter.Transport),
+	}
+
+	get := func() {
+		resp, err := client.Get(server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+
+	// Learn the usual latency.
+	for i := 0; i < 20; i++ {
+		get()
+	}
+	before := limiter.Limit()
+	if before < 4 {
+		t.Fatalf("expected limit to stay about 8, got %v", before)
+	}
+
+	atomic.StoreInt32(&slow, 1)
+	for i := 0; i < 3; i++ {
+		get()
+	}
+	if limit := limiter.Limit(); limit >= before {
+		t.Fatalf("expected limit to drop from %v on slow responses, got %v", before, limit)
+	}
+}
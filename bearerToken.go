@@ -0,0 +1,179 @@
+package transport
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// TokenSource provides bearer tokens for BearerToken.
+type TokenSource interface {
+	// Token returns a new token and its expiry. A zero expiry means
+	// the token doesn't expire.
+	Token(ctx context.Context) (token string, expiry time.Time, err error)
+}
+
+// TokenSourceFunc is an adapter to allow the use of ordinary functions
+// as a TokenSource.
+type TokenSourceFunc func(ctx context.Context) (token string, expiry time.Time, err error)
+
+// Token calls f(ctx).
+func (f TokenSourceFunc) Token(ctx context.Context) (string, time.Time, error) {
+	return f(ctx)
+}
+
+// BearerToken is a middleware setting the "Authorization: Bearer <token>"
+// header with a token obtained from the source.
+//
+// The token is cached and refreshed in the background before it expires,
+// concurrent requests share a single fetch. If the token can't be fetched,
+// the request fails with the wrapped error. A 401 Unauthorized response
+// forces a token refresh and the request is sent once more, provided its
+// body can be replayed.
+//
+//	client := &http.Client{
+//	    Transport: transport.Chain(
+//	        http.DefaultTransport,
+//	        transport.BearerToken(transport.TokenSourceFunc(func(ctx context.Context) (string, time.Time, error) {
+//	            return vault.Token(ctx)
+//	        })),
+//	    ),
+//	}
+func BearerToken(source TokenSource) func(http.RoundTripper) http.RoundTripper {
+	return bearerToken(func(ctx context.Context, _ http.RoundTripper) (string, time.Time, error) {
+		return source.Token(ctx)
+	})
+}
+
+// fetchTokenFunc fetches a new token, optionally through the rest of
+// the chain.
+type fetchTokenFunc func(ctx context.Context, next http.RoundTripper) (token string, expiry time.Time, err error)
+
+// maxReplayBody is the largest request body kept in memory, so the request
+// can be replayed with a refreshed token.
+const maxReplayBody = 1 << 20
+
+func bearerToken(fetch fetchTokenFunc) func(http.RoundTripper) http.RoundTripper {
+	c := &tokenCache{fetch: fetch}
+
+	return func(next http.RoundTripper) http.RoundTripper {
+		return RoundTripFunc(func(req *http.Request) (*http.Response, error) {
+			ctx := req.Context()
+
+			token, err := c.get(ctx, next, "")
+			if err != nil {
+				return nil, fmt.Errorf("transport: fetching bearer token: %w", err)
+			}
+
+			r, err := bufferBody(req, maxReplayBody)
+			if err != nil {
+				return nil, err
+			}
+
+			resp, err := next.RoundTrip(withBearerToken(r, token))
+			if err != nil || resp.StatusCode != http.StatusUnauthorized {
+				return resp, err
+			}
+
+			// The token might have been revoked. Refresh it and try once more.
+			retry, err := rewindBody(r)
+			if err != nil {
+				return resp, nil
+			}
+			drainBody(resp)
+
+			token, err = c.get(ctx, next, token)
+			if err != nil {
+				return nil, fmt.Errorf("transport: refreshing bearer token: %w", err)
+			}
+
+			return next.RoundTrip(withBearerToken(retry, token))
+		})
+	}
+}
+
+func withBearerToken(req *http.Request, token string) *http.Request {
+	r := CloneRequest(req)
+	r.Header.Set("Authorization", "Bearer "+token)
+	return r
+}
+
+// tokenExpiryDelta is how long before its expiry a token is no longer used.
+const tokenExpiryDelta = 10 * time.Second
+
+// timeNow is the clock deciding when tokens are refreshed, replaced
+// in tests.
+var timeNow = time.Now
+
+// tokenFetchTimeout limits how long a token fetch, shared by all waiting
+// requests, can take.
+const tokenFetchTimeout = 30 * time.Second
+
+type tokenCache struct {
+	fetch fetchTokenFunc
+	group singleflight.Group
+
+	mu        sync.Mutex
+	token     string
+	expiry    time.Time // zero if the token doesn't expire
+	refreshAt time.Time // when to start refreshing in the background
+}
+
+// get returns the cached token or fetches a new one. The stale token,
+// if not empty, was rejected by the server and is never returned.
+func (c *tokenCache) get(ctx context.Context, next http.RoundTripper, stale string) (string, error) {
+	c.mu.Lock()
+	token, expiry, refreshAt := c.token, c.expiry, c.refreshAt
+	c.mu.Unlock()
+
+	if token != "" && token != stale {
+		now := timeNow()
+		if expiry.IsZero() || now.Before(refreshAt) {
+			return token, nil
+		}
+		if now.Add(tokenExpiryDelta).Before(expiry) {
+			// Still valid, refresh it before it expires.
+			c.refresh(ctx, next)
+			return token, nil
+		}
+	}
+
+	select {
+	case <-ctx.Done():
+		return "", ctx.Err()
+	case res := <-c.refresh(ctx, next):
+		if res.Err != nil {
+			return "", res.Err
+		}
+		return res.Val.(string), nil
+	}
+}
+
+// refresh fetches a new token, unless a fetch is already in progress.
+func (c *tokenCache) refresh(ctx context.Context, next http.RoundTripper) <-chan singleflight.Result {
+	return c.group.DoChan("", func() (interface{}, error) {
+		// The fetch is shared, so it must not be cancelled together with
+		// the request of the first caller.
+		fetchCtx, cancel := context.WithTimeout(detach(ctx), tokenFetchTimeout)
+		defer cancel()
+
+		token, expiry, err := c.fetch(fetchCtx, next)
+		if err != nil {
+			return nil, err
+		}
+
+		c.mu.Lock()
+		c.token, c.expiry = token, expiry
+		if !expiry.IsZero() {
+			// Refresh after three quarters of the token lifetime.
+			c.refreshAt = expiry.Add(-expiry.Sub(timeNow()) / 4)
+		}
+		c.mu.Unlock()
+
+		return token, nil
+	})
+}
@@ -0,0 +1,187 @@
+package transport_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-chi/transport"
+	"golang.org/x/sync/errgroup"
+)
+
+func TestBearerToken(t *testing.T) {
+	var validToken atomic.Value
+	validToken.Store("token-1")
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer "+validToken.Load().(string) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		io.Copy(w, r.Body)
+	}))
+	defer server.Close()
+
+	newClient := func(fetches *int32, lifetime time.Duration) *http.Client {
+		return &http.Client{
+			Transport: transport.Chain(
+				http.DefaultTransport,
+				transport.BearerToken(transport.TokenSourceFunc(func(ctx context.Context) (string, time.Time, error) {
+					n := atomic.AddInt32(fetches, 1)
+					return fmt.Sprintf("token-%v", n), time.Now().Add(lifetime), nil
+				})),
+			),
+		}
+	}
+
+	post := func(client *http.Client, body string) error {
+		resp, err := client.Post(server.URL, "text/plain", strings.NewReader(body))
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+
+		b, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode != 200 || string(b) != body {
+			return fmt.Errorf("unexpected response: HTTP %v %q", resp.StatusCode, string(b))
+		}
+		return nil
+	}
+
+	t.Run("cached", func(t *testing.T) {
+		var fetches int32
+		client := newClient(&fetches, time.Hour)
+
+		var g errgroup.Group
+		for i := 0; i < 20; i++ {
+			g.Go(func() error {
+				return post(client, "data")
+			})
+		}
+		if err := g.Wait(); err != nil {
+			t.Fatal(err)
+		}
+		if err := post(client, "data"); err != nil {
+			t.Fatal(err)
+		}
+
+		if got := atomic.LoadInt32(&fetches); got != 1 {
+			t.Fatalf("expected 1 token fetch, got %v", got)
+		}
+	})
+
+	t.Run("expiring", func(t *testing.T) {
+		var fetches int32
+		client := newClient(&fetches, 5*time.Second)
+
+		for i := 1; i <= 3; i++ {
+			validToken.Store(fmt.Sprintf("token-%v", i))
+			if err := post(client, "data"); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if got := atomic.LoadInt32(&fetches); got != 3 {
+			t.Fatalf("expected tokens about to expire to be fetched again, got %v fetches", got)
+		}
+	})
+
+	t.Run("refreshed in the background", func(t *testing.T) {
+		var offset int64
+		now := func() time.Time { return time.Now().Add(time.Duration(atomic.LoadInt64(&offset))) }
+		defer transport.SetTimeNow(now)()
+
+		var fetches int32
+		release := make(chan struct{})
+		client := &http.Client{
+			Transport: transport.Chain(
+				http.DefaultTransport,
+				transport.BearerToken(transport.TokenSourceFunc(func(ctx context.Context) (string, time.Time, error) {
+					n := atomic.AddInt32(&fetches, 1)
+					if n > 1 {
+						<-release
+					}
+					return fmt.Sprintf("token-%v", n), now().Add(time.Hour), nil
+				})),
+			),
+		}
+
+		validToken.Store("token-1")
+		if err := post(client, "data"); err != nil {
+			t.Fatal(err)
+		}
+
+		// Past three quarters of the lifetime, requests don't wait for
+		// the new token, but keep using the cached one.
+		atomic.StoreInt64(&offset, int64(50*time.Minute))
+
+		var g errgroup.Group
+		for i := 0; i < 10; i++ {
+			g.Go(func() error {
+				return post(client, "data")
+			})
+		}
+		if err := g.Wait(); err != nil {
+			t.Fatal(err)
+		}
+
+		close(release)
+
+		validToken.Store("token-2")
+		if err := post(client, "data"); err != nil {
+			t.Fatal(err)
+		}
+
+		if got := atomic.LoadInt32(&fetches); got != 2 {
+			t.Fatalf("expected the token to be refreshed once, got %v fetches", got)
+		}
+	})
+
+	t.Run("revoked", func(t *testing.T) {
+		var fetches int32
+		client := newClient(&fetches, time.Hour)
+
+		validToken.Store("token-1")
+		if err := post(client, "data"); err != nil {
+			t.Fatal(err)
+		}
+
+		// The server rejects token-1, the request is replayed with token-2.
+		validToken.Store("token-2")
+		if err := post(client, "replayed data"); err != nil {
+			t.Fatal(err)
+		}
+
+		if got := atomic.LoadInt32(&fetches); got != 2 {
+			t.Fatalf("expected 2 token fetches, got %v", got)
+		}
+	})
+
+	t.Run("fetch error", func(t *testing.T) {
+		errVault := errors.New("vault is sealed")
+		client := &http.Client{
+			Transport: transport.Chain(
+				http.DefaultTransport,
+				transport.BearerToken(transport.TokenSourceFunc(func(ctx context.Context) (string, time.Time, error) {
+					return "", time.Time{}, errVault
+				})),
+			),
+		}
+
+		_, err := client.Get(server.URL)
+		if !errors.Is(err, errVault) {
+			t.Fatalf("expected wrapped source error, got %v", err)
+		}
+	})
+}
@@ -0,0 +1,100 @@
+package transport
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+)
+
+// ErrBodyNotReplayable is returned when a request needs to be sent again,
+// but its body was already consumed and cannot be rewound.
+var ErrBodyNotReplayable = errors.New("transport: request body cannot be replayed")
+
+// bufferBody makes the request body replayable by reading it into memory,
+// unless it already is. Bodies larger than maxBytes are left streaming
+// and the returned request has no GetBody.
+func bufferBody(req *http.Request, maxBytes int64) (*http.Request, error) {
+	if req.Body == nil || req.Body == http.NoBody || req.GetBody != nil {
+		return req, nil
+	}
+
+	buf, err := ioutil.ReadAll(io.LimitReader(req.Body, maxBytes+1))
+	if err != nil {
+		req.Body.Close()
+		return nil, err
+	}
+
+	r := CloneRequest(req)
+	if int64(len(buf)) > maxBytes {
+		// Too large to keep in memory, send what we've read and stream the rest.
+		r.Body = readCloser{io.MultiReader(bytes.NewReader(buf), req.Body), req.Body}
+		return r, nil
+	}
+
+	req.Body.Close()
+	r.GetBody = func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(buf)), nil
+	}
+	r.Body, _ = r.GetBody()
+	return r, nil
+}
+
+// rewindBody returns a copy of the request with a fresh body obtained
+// from GetBody, so it can be sent again.
+func rewindBody(req *http.Request) (*http.Request, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return req, nil
+	}
+	if req.GetBody == nil {
+		return nil, ErrBodyNotReplayable
+	}
+
+	body, err := req.GetBody()
+	if err != nil {
+		return nil, err
+	}
+
+	r := CloneRequest(req)
+	r.Body = body
+	return r, nil
+}
+
+// maxDrainBytes is the most we read from a discarded response body, so the
+// underlying connection can be reused. Larger bodies are cheaper to abandon
+// together with the connection.
+const maxDrainBytes = 64 << 10
+
+// drainBody reads the rest of the response body, up to maxDrainBytes,
+// and closes it.
+func drainBody(resp *http.Response) {
+	if resp == nil || resp.Body == nil {
+		return
+	}
+	io.CopyN(ioutil.Discard, resp.Body, maxDrainBytes)
+	resp.Body.Close()
+}
+
+// onClose wraps the body, so fn is called once the body is closed.
+func onClose(body io.ReadCloser, fn func()) io.ReadCloser {
+	return &closeNotifier{ReadCloser: body, fn: fn}
+}
+
+type closeNotifier struct {
+	io.ReadCloser
+	once sync.Once
+	fn   func()
+}
+
+func (c *closeNotifier) Close() error {
+	err := c.ReadCloser.Close()
+	c.once.Do(c.fn)
+	return err
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
@@ -0,0 +1,618 @@
+package transport
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CacheOptions configures the Cache middleware.
+type CacheOptions struct {
+	// Shared makes the cache behave as a shared cache (e.g. a proxy serving
+	// multiple users), which honors s-maxage and doesn't store private
+	// responses. By default, the cache is private to the client.
+	Shared bool
+
+	// MaxEntryBytes is the largest response body to be cached.
+	// Defaults to 8 MiB.
+	MaxEntryBytes int
+}
+
+// Cache is a middleware caching responses to GET requests in the given store,
+// per RFC 9111 (HTTP Caching). Fresh responses are served from the cache
+// without a round trip. Stale responses with ETag or Last-Modified are
+// revalidated with a conditional request and, if the server responds with
+// 304 Not Modified, served from the cache with updated headers.
+//
+// The stale-while-revalidate and stale-if-error extensions (RFC 5861) are
+// supported: stale responses are served while being refreshed in background,
+// or while the upstream responds with 5xx errors or can't be reached.
+//
+//	client := &http.Client{
+//	    Transport: transport.Chain(
+//	        http.DefaultTransport,
+//	        transport.Cache(transport.NewMemoryCache(64 << 20)),
+//	    ),
+//	}
+func Cache(store CacheStore) func(http.RoundTripper) http.RoundTripper {
+	return CacheWithOptions(store, CacheOptions{})
+}
+
+// CacheWithOptions is like Cache, but it can be configured as a shared cache.
+func CacheWithOptions(store CacheStore, opts CacheOptions) func(http.RoundTripper) http.RoundTripper {
+	if opts.MaxEntryBytes <= 0 {
+		opts.MaxEntryBytes = 8 << 20
+	}
+	c := &cache{
+		store:      store,
+		opts:       opts,
+		refreshing: map[string]bool{},
+	}
+
+	return func(next http.RoundTripper) http.RoundTripper {
+		return RoundTripFunc(func(req *http.Request) (*http.Response, error) {
+			return c.roundTrip(next, req)
+		})
+	}
+}
+
+type cache struct {
+	store CacheStore
+	opts  CacheOptions
+
+	mu         sync.Mutex
+	refreshing map[string]bool // keys being refreshed in background
+}
+
+// cacheEntry is a stored response.
+type cacheEntry struct {
+	StatusCode   int
+	Status       string
+	Header       http.Header
+	Body         []byte
+	RequestTime  time.Time   // when the request was sent
+	ResponseTime time.Time   // when the response was received
+	Vary         http.Header // request headers the response varies on
+}
+
+func (c *cache) roundTrip(next http.RoundTripper, req *http.Request) (*http.Response, error) {
+	key := cacheKey(req)
+
+	if req.Method != "GET" {
+		resp, err := next.RoundTrip(req)
+
+		// Unsafe methods invalidate the cached response, see RFC 9111 section 4.4.
+		if err == nil && !isSafeMethod(req.Method) && resp.StatusCode < 400 {
+			c.store.Delete(key)
+		}
+		return resp, err
+	}
+
+	reqCC := parseCacheControl(req.Header)
+	if _, ok := reqCC["no-store"]; ok {
+		return next.RoundTrip(req)
+	}
+
+	entry, cached := c.load(key, req)
+	if cached {
+		now := time.Now()
+		if c.isFresh(entry, reqCC, now) {
+			return entry.response(req, now), nil
+		}
+		if c.canServeStale(entry, reqCC, "stale-while-revalidate", now) {
+			resp := entry.response(req, now)
+			c.refreshInBackground(next, key, req, reqCC, entry)
+			return resp, nil
+		}
+	}
+
+	resp, err := c.fetch(next, key, req, reqCC, entry)
+
+	// Keep serving the stale response while the upstream is failing.
+	if cached && (err != nil || isServerError(resp.StatusCode)) && c.canServeStale(entry, reqCC, "stale-if-error", time.Now()) {
+		drainBody(resp)
+		return entry.response(req, time.Now()), nil
+	}
+
+	return resp, err
+}
+
+// fetch sends the request upstream and stores the response. The stale
+// entry, if any, is revalidated.
+func (c *cache) fetch(next http.RoundTripper, key string, req *http.Request, reqCC map[string]string, entry *cacheEntry) (*http.Response, error) {
+	// Ask the server whether the stale response is still good, unless
+	// the caller sends conditional headers of its own.
+	r := req
+	if entry != nil && !isConditional(req) {
+		r = entry.conditionalRequest(req)
+	}
+
+	requestTime := time.Now()
+	resp, err := next.RoundTrip(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if r != req && resp.StatusCode == http.StatusNotModified {
+		if entry.update(resp, requestTime, time.Now()) {
+			drainBody(resp)
+			c.save(key, entry)
+			return entry.response(req, time.Now()), nil
+		}
+
+		// The 304 refers to a different response than the one we have.
+		drainBody(resp)
+		c.store.Delete(key)
+
+		requestTime = time.Now()
+		resp, err = next.RoundTrip(req)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if c.isStorable(req, reqCC, resp) {
+		c.storeOnEOF(key, req, resp, requestTime, time.Now())
+	}
+	return resp, nil
+}
+
+// refreshInBackground fetches a fresh response for the stale entry, unless
+// it's already being refreshed, see RFC 5861 section 3.
+func (c *cache) refreshInBackground(next http.RoundTripper, key string, req *http.Request, reqCC map[string]string, entry *cacheEntry) {
+	c.mu.Lock()
+	if c.refreshing[key] {
+		c.mu.Unlock()
+		return
+	}
+	c.refreshing[key] = true
+	c.mu.Unlock()
+
+	// The refresh outlives the request, so it must not be cancelled with it.
+	ctx, cancel := context.WithTimeout(detach(req.Context()), backgroundRefreshTimeout)
+	r := CloneRequest(req).WithContext(ctx)
+
+	go func() {
+		defer func() {
+			cancel()
+			c.mu.Lock()
+			delete(c.refreshing, key)
+			c.mu.Unlock()
+		}()
+
+		resp, err := c.fetch(next, key, r, reqCC, entry)
+		if err != nil {
+			return
+		}
+
+		// Read the body to the end, so the response gets stored.
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+	}()
+}
+
+// backgroundRefreshTimeout limits how long a stale-while-revalidate refresh
+// can take.
+const backgroundRefreshTimeout = time.Minute
+
+// load returns the cached response matching the request.
+func (c *cache) load(key string, req *http.Request) (*cacheEntry, bool) {
+	data, ok := c.store.Get(key)
+	if !ok {
+		return nil, false
+	}
+
+	var entry cacheEntry
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&entry); err != nil {
+		c.store.Delete(key)
+		return nil, false
+	}
+
+	// The cached response must have been selected with the same request
+	// headers, see RFC 9111 section 4.1.
+	for name, values := range entry.Vary {
+		if strings.Join(req.Header.Values(name), ", ") != strings.Join(values, ", ") {
+			return nil, false
+		}
+	}
+
+	return &entry, true
+}
+
+func (c *cache) save(key string, entry *cacheEntry) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(entry); err != nil {
+		return
+	}
+	c.store.Set(key, buf.Bytes())
+}
+
+// storeOnEOF stores the response once its body is read to the end.
+func (c *cache) storeOnEOF(key string, req *http.Request, resp *http.Response, requestTime, responseTime time.Time) {
+	vary := http.Header{}
+	for _, name := range varyHeaders(resp.Header) {
+		vary[http.CanonicalHeaderKey(name)] = req.Header.Values(name)
+	}
+
+	resp.Body = &cachingBody{
+		ReadCloser: resp.Body,
+		maxBytes:   c.opts.MaxEntryBytes,
+		onEOF: func(body []byte) {
+			c.save(key, &cacheEntry{
+				StatusCode:   resp.StatusCode,
+				Status:       resp.Status,
+				Header:       resp.Header.Clone(),
+				Body:         body,
+				RequestTime:  requestTime,
+				ResponseTime: responseTime,
+				Vary:         vary,
+			})
+		},
+	}
+}
+
+// isStorable reports whether the response can be stored, see RFC 9111 section 3.
+func (c *cache) isStorable(req *http.Request, reqCC map[string]string, resp *http.Response) bool {
+	switch {
+	case resp.StatusCode == http.StatusPartialContent:
+		// Partial responses would need to be combined, which we don't do.
+		return false
+	case resp.StatusCode == http.StatusFound, resp.StatusCode == http.StatusTemporaryRedirect:
+		// Cacheable with explicit freshness only.
+	case !isHeuristicallyCacheable(resp.StatusCode):
+		return false
+	}
+	if _, ok := reqCC["no-store"]; ok {
+		return false
+	}
+
+	cc := parseCacheControl(resp.Header)
+	if _, ok := cc["no-store"]; ok {
+		return false
+	}
+	for _, name := range varyHeaders(resp.Header) {
+		if name == "*" {
+			return false
+		}
+	}
+
+	_, public := cc["public"]
+	_, sMaxAge := cc["s-maxage"]
+	if c.opts.Shared {
+		if _, ok := cc["private"]; ok {
+			return false
+		}
+		if req.Header.Get("Authorization") != "" {
+			if _, ok := cc["must-revalidate"]; !ok && !public && !sMaxAge {
+				return false
+			}
+		}
+	}
+
+	if _, ok := cc["max-age"]; ok {
+		return true
+	}
+	if c.opts.Shared && sMaxAge {
+		return true
+	}
+	if resp.Header.Get("Expires") != "" || public {
+		return true
+	}
+	return isHeuristicallyCacheable(resp.StatusCode)
+}
+
+// isFresh reports whether the cached response can be served without
+// contacting the server, see RFC 9111 section 4.2.
+func (c *cache) isFresh(entry *cacheEntry, reqCC map[string]string, now time.Time) bool {
+	if _, ok := reqCC["no-cache"]; ok {
+		return false
+	}
+	cc := parseCacheControl(entry.Header)
+	if _, ok := cc["no-cache"]; ok {
+		return false
+	}
+
+	lifetime := c.freshnessLifetime(entry, cc)
+	age := entry.age(now)
+
+	if maxAge, ok := seconds(reqCC, "max-age"); ok && age > maxAge {
+		return false
+	}
+	if minFresh, ok := seconds(reqCC, "min-fresh"); ok {
+		lifetime -= minFresh
+	}
+	if lifetime > age {
+		return true
+	}
+
+	// The client is willing to accept a stale response, unless the server
+	// forbids it.
+	if _, ok := cc["must-revalidate"]; ok {
+		return false
+	}
+	if v, ok := reqCC["max-stale"]; ok {
+		if v == "" {
+			return true
+		}
+		maxStale, _ := seconds(reqCC, "max-stale")
+		return age-lifetime <= maxStale
+	}
+	return false
+}
+
+// canServeStale reports whether the stale response can be served within the
+// window of the given RFC 5861 directive, stale-while-revalidate or
+// stale-if-error. The window is set by the response, or, for stale-if-error,
+// also by the request.
+func (c *cache) canServeStale(entry *cacheEntry, reqCC map[string]string, directive string, now time.Time) bool {
+	cc := parseCacheControl(entry.Header)
+	if _, ok := cc["must-revalidate"]; ok {
+		return false
+	}
+	if c.opts.Shared {
+		if _, ok := cc["proxy-revalidate"]; ok {
+			return false
+		}
+	}
+	if _, ok := cc["no-cache"]; ok && directive == "stale-while-revalidate" {
+		return false
+	}
+	if _, ok := reqCC["no-cache"]; ok && directive == "stale-while-revalidate" {
+		return false
+	}
+
+	window, ok := seconds(cc, directive)
+	if reqWindow, reqOk := seconds(reqCC, directive); reqOk && directive == "stale-if-error" && (!ok || reqWindow > window) {
+		window, ok = reqWindow, true
+	}
+	if !ok {
+		return false
+	}
+
+	staleness := entry.age(now) - c.freshnessLifetime(entry, cc)
+	return staleness <= window
+}
+
+// freshnessLifetime returns how long the response is fresh after it was
+// generated, see RFC 9111 section 4.2.1.
+func (c *cache) freshnessLifetime(entry *cacheEntry, cc map[string]string) time.Duration {
+	if c.opts.Shared {
+		if sMaxAge, ok := seconds(cc, "s-maxage"); ok {
+			return sMaxAge
+		}
+	}
+	if maxAge, ok := seconds(cc, "max-age"); ok {
+		return maxAge
+	}
+
+	date := entry.date()
+	if v := entry.Header.Get("Expires"); v != "" {
+		expires, err := http.ParseTime(v)
+		if err != nil {
+			// Invalid dates, like "0", represent a time in the past.
+			return 0
+		}
+		return expires.Sub(date)
+	}
+
+	// Heuristic freshness, see RFC 9111 section 4.2.2.
+	if lastModified, err := http.ParseTime(entry.Header.Get("Last-Modified")); err == nil && lastModified.Before(date) {
+		lifetime := date.Sub(lastModified) / 10
+		if lifetime > maxHeuristicLifetime {
+			lifetime = maxHeuristicLifetime
+		}
+		return lifetime
+	}
+	return 0
+}
+
+// maxHeuristicLifetime caps the heuristic freshness lifetime.
+const maxHeuristicLifetime = 24 * time.Hour
+
+// date returns the time the response was generated.
+func (e *cacheEntry) date() time.Time {
+	if date, err := http.ParseTime(e.Header.Get("Date")); err == nil {
+		return date
+	}
+	return e.ResponseTime
+}
+
+// age returns the current age of the response, see RFC 9111 section 4.2.3.
+func (e *cacheEntry) age(now time.Time) time.Duration {
+	apparentAge := nonNegative(e.ResponseTime.Sub(e.date()))
+
+	var ageValue time.Duration
+	if age, err := strconv.ParseInt(e.Header.Get("Age"), 10, 64); err == nil && age > 0 {
+		ageValue = time.Duration(age) * time.Second
+	}
+	correctedAge := ageValue + e.ResponseTime.Sub(e.RequestTime)
+
+	initialAge := apparentAge
+	if correctedAge > initialAge {
+		initialAge = correctedAge
+	}
+	return initialAge + now.Sub(e.ResponseTime)
+}
+
+// conditionalRequest returns a copy of the request asking the server to
+// validate the cached response, see RFC 9111 section 4.3.1.
+func (e *cacheEntry) conditionalRequest(req *http.Request) *http.Request {
+	etag := e.Header.Get("ETag")
+	lastModified := e.Header.Get("Last-Modified")
+	if etag == "" && lastModified == "" {
+		return req
+	}
+
+	r := CloneRequest(req)
+	if etag != "" {
+		r.Header.Set("If-None-Match", etag)
+	}
+	if lastModified != "" {
+		r.Header.Set("If-Modified-Since", lastModified)
+	}
+	return r
+}
+
+// update freshens the cached response with the headers of a 304 Not Modified
+// response, see RFC 9111 section 4.3.4. It reports false if the 304 response
+// doesn't match the cached response.
+func (e *cacheEntry) update(notModified *http.Response, requestTime, responseTime time.Time) bool {
+	if etag := notModified.Header.Get("ETag"); etag != "" && etag != e.Header.Get("ETag") {
+		return false
+	}
+
+	for name, values := range notModified.Header {
+		switch name {
+		case "Content-Length", "Content-Encoding", "Transfer-Encoding", "Connection", "Keep-Alive":
+			continue
+		}
+		e.Header[name] = values
+	}
+	e.RequestTime = requestTime
+	e.ResponseTime = responseTime
+	return true
+}
+
+// response creates a response to the request from the cached entry.
+func (e *cacheEntry) response(req *http.Request, now time.Time) *http.Response {
+	header := e.Header.Clone()
+	header.Set("Age", strconv.FormatInt(int64(e.age(now)/time.Second), 10))
+
+	return &http.Response{
+		Status:        e.Status,
+		StatusCode:    e.StatusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          ioutil.NopCloser(bytes.NewReader(e.Body)),
+		ContentLength: int64(len(e.Body)),
+		Request:       req,
+	}
+}
+
+// cachingBody passes the body through, calling onEOF with the whole body
+// once it's read to the end, unless it's larger than maxBytes.
+type cachingBody struct {
+	io.ReadCloser
+	buf      bytes.Buffer
+	maxBytes int
+	onEOF    func(body []byte)
+	done     bool
+}
+
+func (b *cachingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if b.done {
+		return n, err
+	}
+
+	if b.buf.Len()+n > b.maxBytes {
+		b.done = true
+		b.buf = bytes.Buffer{}
+		return n, err
+	}
+	b.buf.Write(p[:n])
+
+	if err == io.EOF {
+		b.done = true
+		b.onEOF(b.buf.Bytes())
+	}
+	return n, err
+}
+
+// isConditional reports whether the request has conditional headers.
+func isConditional(req *http.Request) bool {
+	for _, name := range []string{"If-None-Match", "If-Modified-Since", "If-Match", "If-Unmodified-Since", "If-Range"} {
+		if req.Header.Get(name) != "" {
+			return true
+		}
+	}
+	return false
+}
+
+func cacheKey(req *http.Request) string {
+	return req.URL.String()
+}
+
+func isServerError(statusCode int) bool {
+	switch statusCode {
+	case 500, 502, 503, 504:
+		return true
+	}
+	return false
+}
+
+func isSafeMethod(method string) bool {
+	switch method {
+	case "GET", "HEAD", "OPTIONS", "TRACE":
+		return true
+	}
+	return false
+}
+
+// isHeuristicallyCacheable reports whether responses with the status code
+// can be cached without explicit freshness, see RFC 9110 section 15.1.
+func isHeuristicallyCacheable(statusCode int) bool {
+	switch statusCode {
+	case 200, 203, 204, 206, 300, 301, 308, 404, 405, 410, 414, 501:
+		return true
+	}
+	return false
+}
+
+func varyHeaders(h http.Header) []string {
+	var names []string
+	for _, v := range h.Values("Vary") {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				names = append(names, name)
+			}
+		}
+	}
+	return names
+}
+
+// parseCacheControl parses the Cache-Control header (or Pragma: no-cache
+// in its absence) into lower-cased directives and their unquoted values.
+func parseCacheControl(h http.Header) map[string]string {
+	cc := map[string]string{}
+	for _, v := range h.Values("Cache-Control") {
+		for _, directive := range strings.Split(v, ",") {
+			directive = strings.TrimSpace(directive)
+			if directive == "" {
+				continue
+			}
+			name, value := directive, ""
+			if i := strings.Index(directive, "="); i >= 0 {
+				name, value = directive[:i], strings.Trim(strings.TrimSpace(directive[i+1:]), `"`)
+			}
+			cc[strings.ToLower(strings.TrimSpace(name))] = value
+		}
+	}
+	if len(cc) == 0 && strings.Contains(strings.ToLower(h.Get("Pragma")), "no-cache") {
+		cc["no-cache"] = ""
+	}
+	return cc
+}
+
+// seconds returns a delta-seconds directive value as duration.
+func seconds(cc map[string]string, directive string) (time.Duration, bool) {
+	v, ok := cc[directive]
+	if !ok {
+		return 0, false
+	}
+	s, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || s < 0 {
+		// Invalid values are treated as zero, see RFC 9111 section 1.2.2.
+		return 0, true
+	}
+	return time.Duration(s) * time.Second, true
+}
@@ -0,0 +1,158 @@
+package transport
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// CacheStore stores cached responses for the Cache middleware.
+// Implementations must be safe for concurrent use.
+type CacheStore interface {
+	// Get returns the value stored under the key, if any.
+	Get(key string) ([]byte, bool)
+	// Set stores the value under the key.
+	Set(key string, value []byte)
+	// Delete removes the value stored under the key.
+	Delete(key string)
+}
+
+// MemoryCache is an in-memory CacheStore, which evicts the least recently
+// used entries once it grows over its size in bytes.
+type MemoryCache struct {
+	maxBytes int64
+
+	mu      sync.Mutex
+	size    int64
+	lru     *list.List // of *memoryCacheEntry, most recently used at the front
+	entries map[string]*list.Element
+}
+
+type memoryCacheEntry struct {
+	key   string
+	value []byte
+}
+
+var _ CacheStore = (*MemoryCache)(nil)
+
+// NewMemoryCache creates a MemoryCache holding up to maxBytes of keys
+// and values.
+func NewMemoryCache(maxBytes int64) *MemoryCache {
+	return &MemoryCache{
+		maxBytes: maxBytes,
+		lru:      list.New(),
+		entries:  map[string]*list.Element{},
+	}
+}
+
+// Get returns the value stored under the key, if any.
+func (c *MemoryCache) Get(key string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	c.lru.MoveToFront(elem)
+	return elem.Value.(*memoryCacheEntry).value, true
+}
+
+// Set stores the value under the key. Values larger than the cache size
+// are not stored.
+func (c *MemoryCache) Set(key string, value []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.delete(key)
+
+	size := int64(len(key) + len(value))
+	if size > c.maxBytes {
+		return
+	}
+
+	c.entries[key] = c.lru.PushFront(&memoryCacheEntry{key: key, value: value})
+	c.size += size
+
+	for c.size > c.maxBytes {
+		c.delete(c.lru.Back().Value.(*memoryCacheEntry).key)
+	}
+}
+
+// Delete removes the value stored under the key.
+func (c *MemoryCache) Delete(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.delete(key)
+}
+
+func (c *MemoryCache) delete(key string) {
+	elem, ok := c.entries[key]
+	if !ok {
+		return
+	}
+	entry := c.lru.Remove(elem).(*memoryCacheEntry)
+	delete(c.entries, key)
+	c.size -= int64(len(entry.key) + len(entry.value))
+}
+
+// DiskCache is a CacheStore keeping each value in a file within a directory.
+// Errors are ignored, so a broken disk results in cache misses.
+type DiskCache struct {
+	dir string
+}
+
+var _ CacheStore = (*DiskCache)(nil)
+
+// NewDiskCache creates a DiskCache in the given directory. The directory
+// is created by the first Set, if it doesn't exist yet.
+func NewDiskCache(dir string) *DiskCache {
+	return &DiskCache{dir: dir}
+}
+
+// Get returns the value stored under the key, if any.
+func (c *DiskCache) Get(key string) ([]byte, bool) {
+	value, err := ioutil.ReadFile(c.path(key))
+	if err != nil {
+		return nil, false
+	}
+	return value, true
+}
+
+// Set stores the value under the key.
+func (c *DiskCache) Set(key string, value []byte) {
+	if err := os.MkdirAll(c.dir, 0700); err != nil {
+		return
+	}
+
+	// Write to a temp file first, so readers never see a partial value.
+	f, err := ioutil.TempFile(c.dir, ".tmp-")
+	if err != nil {
+		return
+	}
+	_, err = f.Write(value)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), c.path(key))
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+}
+
+// Delete removes the value stored under the key.
+func (c *DiskCache) Delete(key string) {
+	os.Remove(c.path(key))
+}
+
+func (c *DiskCache) path(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(c.dir, hex.EncodeToString(sum[:]))
+}
@@ -0,0 +1,372 @@
+package transport_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-chi/transport"
+)
+
+func TestCache(t *testing.T) {
+	var hits int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+
+		switch r.URL.Path {
+		case "/max-age":
+			w.Header().Set("Cache-Control", "max-age=60")
+		case "/no-store":
+			w.Header().Set("Cache-Control", "no-store")
+		case "/expired":
+			w.Header().Set("Expires", time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat))
+		case "/vary":
+			w.Header().Set("Cache-Control", "max-age=60")
+			w.Header().Set("Vary", "Accept-Language")
+		case "/private":
+			w.Header().Set("Cache-Control", "private, max-age=60")
+		case "/s-maxage":
+			w.Header().Set("Cache-Control", "max-age=0, s-maxage=60")
+		case "/heuristic":
+			w.Header().Set("Last-Modified", time.Now().Add(-10*time.Hour).UTC().Format(http.TimeFormat))
+		}
+
+		fmt.Fprintf(w, "%s %s", r.URL.Path, r.Header.Get("Accept-Language"))
+	}))
+	defer server.Close()
+
+	privateCache := &http.Client{
+		Transport: transport.Chain(
+			http.DefaultTransport,
+			transport.Cache(transport.NewMemoryCache(1<<20)),
+		),
+	}
+	sharedCache := &http.Client{
+		Transport: transport.Chain(
+			http.DefaultTransport,
+			transport.CacheWithOptions(transport.NewMemoryCache(1<<20), transport.CacheOptions{Shared: true}),
+		),
+	}
+
+	get := func(t *testing.T, client *http.Client, path string, acceptLanguage string) string {
+		req, err := http.NewRequest("GET", server.URL+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if acceptLanguage != "" {
+			req.Header.Set("Accept-Language", acceptLanguage)
+		}
+
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		b, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(b)
+	}
+
+	tt := []struct {
+		name   string
+		client *http.Client
+		path   string
+		hits   int32
+	}{
+		{"max-age", privateCache, "/max-age", 1},
+		{"no-store", privateCache, "/no-store", 3},
+		{"expired", privateCache, "/expired", 3},
+		{"heuristic freshness", privateCache, "/heuristic", 1},
+		{"private response in private cache", privateCache, "/private", 1},
+		{"private response in shared cache", sharedCache, "/private", 3},
+		{"s-maxage in private cache", privateCache, "/s-maxage", 3},
+		{"s-maxage in shared cache", sharedCache, "/s-maxage", 1},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			atomic.StoreInt32(&hits, 0)
+
+			for i := 0; i < 3; i++ {
+				if got := get(t, tc.client, tc.path, ""); got != tc.path+" " {
+					t.Fatalf("unexpected response: %q", got)
+				}
+			}
+
+			if got := atomic.LoadInt32(&hits); got != tc.hits {
+				t.Fatalf("expected %v requests to hit the server, got %v", tc.hits, got)
+			}
+		})
+	}
+
+	t.Run("vary", func(t *testing.T) {
+		atomic.StoreInt32(&hits, 0)
+
+		for _, lang := range []string{"en", "en", "cs", "cs"} {
+			if got := get(t, privateCache, "/vary", lang); got != "/vary "+lang {
+				t.Fatalf("unexpected response: %q", got)
+			}
+		}
+
+		// The server is hit once for "en" and once for "cs".
+		if got := atomic.LoadInt32(&hits); got != 2 {
+			t.Fatalf("expected 2 requests to hit the server, got %v", got)
+		}
+	})
+
+	t.Run("unsafe method invalidates", func(t *testing.T) {
+		atomic.StoreInt32(&hits, 0)
+
+		get(t, privateCache, "/max-age", "") // Cached by the max-age test.
+
+		resp, err := privateCache.Post(server.URL+"/max-age", "text/plain", strings.NewReader("update"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		get(t, privateCache, "/max-age", "")
+
+		if got := atomic.LoadInt32(&hits); got != 2 {
+			t.Fatalf("expected 2 requests to hit the server, got %v", got)
+		}
+	})
+}
+
+func TestCacheStores(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	stores := map[string]transport.CacheStore{
+		"memory": transport.NewMemoryCache(1 << 20),
+		"disk":   transport.NewDiskCache(dir),
+	}
+
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+			if _, ok := store.Get("key"); ok {
+				t.Fatal("expected empty store")
+			}
+
+			store.Set("key", []byte("value"))
+			if value, ok := store.Get("key"); !ok || string(value) != "value" {
+				t.Fatalf("expected value, got %q", value)
+			}
+
+			store.Delete("key")
+			if _, ok := store.Get("key"); ok {
+				t.Fatal("expected deleted value")
+			}
+		})
+	}
+}
+
+func TestMemoryCacheEviction(t *testing.T) {
+	store := transport.NewMemoryCache(30)
+
+	store.Set("a", []byte("123456789")) // 10 bytes incl. key
+	store.Set("b", []byte("123456789"))
+	store.Set("c", []byte("123456789"))
+	store.Get("a") // Make "b" the least recently used.
+	store.Set("d", []byte("123456789"))
+
+	for key, expected := range map[string]bool{"a": true, "b": false, "c": true, "d": true} {
+		if _, ok := store.Get(key); ok != expected {
+			t.Errorf("expected %q to be cached: %v", key, expected)
+		}
+	}
+}
+
+func TestCacheRevalidation(t *testing.T) {
+	lastModified := time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat)
+
+	var hits, notModified int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+
+		switch r.URL.Path {
+		case "/etag":
+			w.Header().Set("Cache-Control", "no-cache")
+			w.Header().Set("ETag", `"v1"`)
+			if r.Header.Get("If-None-Match") == `"v1"` {
+				atomic.AddInt32(&notModified, 1)
+				w.Header().Set("X-Version", "2")
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+		case "/last-modified":
+			w.Header().Set("Cache-Control", "max-age=0")
+			w.Header().Set("Last-Modified", lastModified)
+			if r.Header.Get("If-Modified-Since") == lastModified {
+				atomic.AddInt32(&notModified, 1)
+				w.Header().Set("X-Version", "2")
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+		}
+
+		w.Header().Set("X-Version", "1")
+		fmt.Fprintf(w, "large JSON")
+	}))
+	defer server.Close()
+
+	client := &http.Client{
+		Transport: transport.Chain(
+			http.DefaultTransport,
+			transport.Cache(transport.NewMemoryCache(1<<20)),
+		),
+	}
+
+	for _, path := range []string{"/etag", "/last-modified"} {
+		t.Run(path, func(t *testing.T) {
+			atomic.StoreInt32(&hits, 0)
+			atomic.StoreInt32(&notModified, 0)
+
+			for i := 0; i < 3; i++ {
+				resp, err := client.Get(server.URL + path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				b, err := ioutil.ReadAll(resp.Body)
+				resp.Body.Close()
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if resp.StatusCode != 200 || string(b) != "large JSON" {
+					t.Fatalf("unexpected response: HTTP %v %q", resp.StatusCode, string(b))
+				}
+				if i > 0 && resp.Header.Get("X-Version") != "2" {
+					t.Fatalf("expected headers updated by 304 response, got X-Version %q", resp.Header.Get("X-Version"))
+				}
+			}
+
+			if got := atomic.LoadInt32(&hits); got != 3 {
+				t.Fatalf("expected every request to be revalidated, got %v requests", got)
+			}
+			if got := atomic.LoadInt32(&notModified); got != 2 {
+				t.Fatalf("expected 2 responses to be 304 Not Modified, got %v", got)
+			}
+		})
+	}
+}
+
+func TestCacheStaleWhileRevalidate(t *testing.T) {
+	var hits int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		version := atomic.AddInt32(&hits, 1)
+		if version > 1 {
+			time.Sleep(50 * time.Millisecond) // Slow refresh.
+		}
+
+		w.Header().Set("Cache-Control", "max-age=0, stale-while-revalidate=60")
+		fmt.Fprintf(w, "v%v", version)
+	}))
+	defer server.Close()
+
+	client := &http.Client{
+		Transport: transport.Chain(
+			http.DefaultTransport,
+			transport.Cache(transport.NewMemoryCache(1<<20)),
+		),
+	}
+
+	get := func() string {
+		resp, err := client.Get(server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		b, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(b)
+	}
+
+	if got := get(); got != "v1" {
+		t.Fatalf("expected v1, got %q", got)
+	}
+
+	// Stale responses are served immediately, while being refreshed once.
+	timeStart := time.Now()
+	for i := 0; i < 5; i++ {
+		if got := get(); got != "v1" {
+			t.Fatalf("expected stale v1, got %q", got)
+		}
+	}
+	if elapsed := time.Since(timeStart); elapsed > 40*time.Millisecond {
+		t.Fatalf("expected stale responses to be served without waiting, but took %v", elapsed)
+	}
+
+	// Wait for the refresh.
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if get() == "v2" {
+			break
+		}
+	}
+
+	if got := atomic.LoadInt32(&hits); got < 2 || got > 3 {
+		t.Fatalf("expected a single refresh at a time, got %v requests", got)
+	}
+}
+
+func TestCacheStaleIfError(t *testing.T) {
+	var failing int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&failing) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		w.Header().Set("Cache-Control", "max-age=0, stale-if-error=60")
+		fmt.Fprintf(w, "ok")
+	}))
+	defer server.Close()
+
+	client := &http.Client{
+		Transport: transport.Chain(
+			http.DefaultTransport,
+			transport.Cache(transport.NewMemoryCache(1<<20)),
+		),
+	}
+
+	get := func() (int, string) {
+		resp, err := client.Get(server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		b, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode, string(b)
+	}
+
+	get()
+
+	atomic.StoreInt32(&failing, 1)
+	if status, body := get(); status != 200 || body != "ok" {
+		t.Fatalf("expected stale response on 5xx error, got HTTP %v %q", status, body)
+	}
+
+	server.Close()
+	if status, body := get(); status != 200 || body != "ok" {
+		t.Fatalf("expected stale response on network error, got HTTP %v %q", status, body)
+	}
+}
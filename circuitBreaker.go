@@ -0,0 +1,255 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen is returned by CircuitBreaker for requests that were
+// rejected without being sent, because the upstream is failing.
+var ErrCircuitOpen = errors.New("transport: circuit breaker is open")
+
+// CircuitState is a state of a circuit breaker.
+type CircuitState int
+
+const (
+	// CircuitClosed lets all requests through.
+	CircuitClosed CircuitState = iota
+	// CircuitOpen rejects all requests with ErrCircuitOpen.
+	CircuitOpen
+	// CircuitHalfOpen lets a limited number of probe requests through
+	// to find out whether the upstream has recovered.
+	CircuitHalfOpen
+)
+
+func (s CircuitState) String() string {
+	switch s {
+	case CircuitClosed:
+		return "closed"
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half-open"
+	}
+	return fmt.Sprintf("CircuitState(%d)", int(s))
+}
+
+// CircuitBreakerOptions configures a CircuitBreaker. Zero values fall back
+// to the documented defaults.
+type CircuitBreakerOptions struct {
+	// Key returns the circuit a request belongs to. Defaults to req.URL.Host.
+	Key func(req *http.Request) string
+
+	// FailureRate opens the circuit once the ratio of failed requests
+	// within Window reaches it. Defaults to 0.5.
+	FailureRate float64
+
+	// MinRequests is the number of requests within Window needed before
+	// the failure rate is considered. Defaults to 10.
+	MinRequests int
+
+	// Window is the sliding window the failure rate is computed over.
+	// Defaults to 10s.
+	Window time.Duration
+
+	// Cooldown is how long the circuit stays open before letting probe
+	// requests through. Defaults to 30s.
+	Cooldown time.Duration
+
+	// HalfOpenProbes is the number of probe requests that must succeed
+	// to close the circuit again. Defaults to 1.
+	HalfOpenProbes int
+
+	// IsFailure reports whether a request failed. Defaults to transport
+	// errors and 5xx responses.
+	IsFailure func(resp *http.Response, err error) bool
+
+	// OnStateChange, if set, is called whenever a circuit changes state.
+	OnStateChange func(key string, from, to CircuitState)
+}
+
+// CircuitBreaker stops sending requests to upstreams that keep failing,
+// giving them time to recover, and fails fast with ErrCircuitOpen instead.
+// Each upstream host has its own circuit. Use its Transport method as
+// a middleware:
+//
+//	breaker := transport.NewCircuitBreaker(transport.CircuitBreakerOptions{
+//	    FailureRate: 0.5,
+//	    Cooldown:    10 * time.Second,
+//	})
+//
+//	client := &http.Client{
+//	    Transport: transport.Chain(http.DefaultTransport, breaker.Transport),
+//	}
+type CircuitBreaker struct {
+	opts CircuitBreakerOptions
+
+	mu       sync.Mutex
+	circuits map[string]*circuit
+}
+
+type circuit struct {
+	state     CircuitState
+	window    *slidingWindow
+	openedAt  time.Time
+	probes    int // probes in flight
+	successes int // successful probes
+}
+
+// NewCircuitBreaker creates a CircuitBreaker.
+func NewCircuitBreaker(opts CircuitBreakerOptions) *CircuitBreaker {
+	if opts.Key == nil {
+		opts.Key = func(req *http.Request) string { return req.URL.Host }
+	}
+	if opts.FailureRate <= 0 {
+		opts.FailureRate = 0.5
+	}
+	if opts.MinRequests <= 0 {
+		opts.MinRequests = 10
+	}
+	if opts.Window <= 0 {
+		opts.Window = 10 * time.Second
+	}
+	if opts.Cooldown <= 0 {
+		opts.Cooldown = 30 * time.Second
+	}
+	if opts.HalfOpenProbes <= 0 {
+		opts.HalfOpenProbes = 1
+	}
+	if opts.IsFailure == nil {
+		opts.IsFailure = func(resp *http.Response, err error) bool {
+			return err != nil || resp.StatusCode >= 500
+		}
+	}
+
+	return &CircuitBreaker{
+		opts:     opts,
+		circuits: map[string]*circuit{},
+	}
+}
+
+// State returns the current state of the circuit with the given key.
+func (cb *CircuitBreaker) State(key string) CircuitState {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	c, ok := cb.circuits[key]
+	if !ok {
+		return CircuitClosed
+	}
+	if c.state == CircuitOpen && time.Since(c.openedAt) >= cb.opts.Cooldown {
+		return CircuitHalfOpen
+	}
+	return c.state
+}
+
+// Transport is the circuit breaker middleware.
+func (cb *CircuitBreaker) Transport(next http.RoundTripper) http.RoundTripper {
+	return RoundTripFunc(func(req *http.Request) (*http.Response, error) {
+		key := cb.opts.Key(req)
+
+		probe, ok := cb.allow(key)
+		if !ok {
+			return nil, fmt.Errorf("%w: %v", ErrCircuitOpen, key)
+		}
+
+		resp, err := next.RoundTrip(req)
+
+		// Requests cancelled by the caller say nothing about the upstream.
+		cancelled := err != nil && errors.Is(req.Context().Err(), context.Canceled)
+		cb.record(key, probe, cancelled, !cancelled && cb.opts.IsFailure(resp, err))
+
+		return resp, err
+	})
+}
+
+// allow reports whether a request can be sent and whether it's a probe.
+func (cb *CircuitBreaker) allow(key string) (probe bool, ok bool) {
+	cb.mu.Lock()
+
+	c, found := cb.circuits[key]
+	if !found {
+		c = &circuit{window: newSlidingWindow(cb.opts.Window, 10)}
+		cb.circuits[key] = c
+	}
+
+	from := c.state
+	switch c.state {
+	case CircuitClosed:
+		cb.mu.Unlock()
+		return false, true
+
+	case CircuitOpen:
+		if time.Since(c.openedAt) < cb.opts.Cooldown {
+			cb.mu.Unlock()
+			return false, false
+		}
+		c.state = CircuitHalfOpen
+		c.probes, c.successes = 0, 0
+	}
+
+	if c.probes+c.successes >= cb.opts.HalfOpenProbes {
+		cb.mu.Unlock()
+		cb.stateChanged(key, from, CircuitHalfOpen)
+		return false, false
+	}
+	c.probes++
+	cb.mu.Unlock()
+
+	cb.stateChanged(key, from, CircuitHalfOpen)
+	return true, true
+}
+
+func (cb *CircuitBreaker) record(key string, probe bool, ignore bool, failed bool) {
+	cb.mu.Lock()
+
+	c := cb.circuits[key]
+	from := c.state
+	now := time.Now()
+
+	switch {
+	case probe:
+		c.probes--
+		if c.state != CircuitHalfOpen || ignore {
+			break
+		}
+		if failed {
+			c.state = CircuitOpen
+			c.openedAt = now
+			break
+		}
+		c.successes++
+		if c.successes >= cb.opts.HalfOpenProbes {
+			c.state = CircuitClosed
+			c.window.reset()
+		}
+
+	case c.state == CircuitClosed && !ignore:
+		var marked int
+		if failed {
+			marked = 1
+		}
+		c.window.add(now, 1, marked)
+
+		total, failures := c.window.sum(now)
+		if total >= cb.opts.MinRequests && float64(failures)/float64(total) >= cb.opts.FailureRate {
+			c.state = CircuitOpen
+			c.openedAt = now
+		}
+	}
+
+	to := c.state
+	cb.mu.Unlock()
+
+	cb.stateChanged(key, from, to)
+}
+
+func (cb *CircuitBreaker) stateChanged(key string, from, to CircuitState) {
+	if from != to && cb.opts.OnStateChange != nil {
+		cb.opts.OnStateChange(key, from, to)
+	}
+}
@@ -0,0 +1,86 @@
+package transport_test
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-chi/transport"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	var hits, healthy int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		if atomic.LoadInt32(&healthy) == 0 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprintf(w, "ok")
+	}))
+	defer server.Close()
+
+	var mu sync.Mutex
+	var transitions []string
+
+	breaker := transport.NewCircuitBreaker(transport.CircuitBreakerOptions{
+		MinRequests: 3,
+		FailureRate: 0.5,
+		Cooldown:    50 * time.Millisecond,
+		OnStateChange: func(key string, from, to transport.CircuitState) {
+			mu.Lock()
+			defer mu.Unlock()
+			transitions = append(transitions, fmt.Sprintf("%v->%v", from, to))
+		},
+	})
+	client := &http.Client{
+		Transport: transport.Chain(http.DefaultTransport, breaker.Transport),
+	}
+
+	for i := 0; i < 3; i++ {
+		resp, err := client.Get(server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+
+	host := strings.TrimPrefix(server.URL, "http://")
+	if state := breaker.State(host); state != transport.CircuitOpen {
+		t.Fatalf("expected open circuit, got %v", state)
+	}
+
+	_, err := client.Get(server.URL)
+	if !errors.Is(err, transport.ErrCircuitOpen) {
+		t.Fatalf("expected ErrCircuitOpen, got %v", err)
+	}
+	if got := atomic.LoadInt32(&hits); got != 3 {
+		t.Fatalf("expected open circuit to fail fast, but server got %v requests", got)
+	}
+
+	// Let the upstream recover and wait for the cooldown.
+	atomic.StoreInt32(&healthy, 1)
+	time.Sleep(60 * time.Millisecond)
+
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if state := breaker.State(host); state != transport.CircuitClosed {
+		t.Fatalf("expected closed circuit, got %v", state)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if got := strings.Join(transitions, " "); got != "closed->open open->half-open half-open->closed" {
+		t.Fatalf("unexpected state transitions: %v", got)
+	}
+}
@@ -0,0 +1,148 @@
+package transport
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// Coalesce is a middleware that collapses concurrent identical GET and HEAD
+// requests into a single upstream request, which helps against thundering
+// herds, e.g. on a cold cache. Each caller receives its own copy of the
+// response, so the response body is read into memory.
+//
+// Requests are identical if they have the same method, URL, Authorization
+// and Cookie headers, and the same values of the given keyHeaders:
+//
+//	transport.Coalesce("Accept", "Accept-Encoding")
+//
+// The upstream request is cancelled once all the callers waiting for it
+// are gone.
+func Coalesce(keyHeaders ...string) func(http.RoundTripper) http.RoundTripper {
+	keyHeaders = append([]string{"Authorization", "Cookie"}, keyHeaders...)
+
+	var group singleflight.Group
+
+	var mu sync.Mutex
+	flights := map[string]*flight{}
+
+	return func(next http.RoundTripper) http.RoundTripper {
+		return RoundTripFunc(func(req *http.Request) (*http.Response, error) {
+			if req.Method != "GET" && req.Method != "HEAD" {
+				return next.RoundTrip(req)
+			}
+
+			ctx := req.Context()
+			key := coalesceKey(req, keyHeaders)
+
+			mu.Lock()
+			f, ok := flights[key]
+			if !ok {
+				// The request is shared, so it must not be cancelled together
+				// with the request of the first caller.
+				f = &flight{}
+				f.ctx, f.cancel = context.WithCancel(detach(ctx))
+				flights[key] = f
+			}
+			f.waiters++
+
+			// Join the shared request while holding the lock, so a flight
+			// found in the map always has its request still running.
+			ch := group.DoChan(key, func() (interface{}, error) {
+				defer func() {
+					// Callers arriving from now on start a new flight.
+					mu.Lock()
+					if flights[key] == f {
+						delete(flights, key)
+					}
+					mu.Unlock()
+					f.cancel()
+				}()
+
+				resp, err := next.RoundTrip(CloneRequest(req).WithContext(f.ctx))
+				if err != nil {
+					return nil, err
+				}
+				defer resp.Body.Close()
+
+				body, err := ioutil.ReadAll(resp.Body)
+				if err != nil {
+					return nil, err
+				}
+				return &coalescedResponse{resp: resp, body: body}, nil
+			})
+			mu.Unlock()
+
+			leave := func() {
+				mu.Lock()
+				defer mu.Unlock()
+
+				f.waiters--
+				if f.waiters == 0 && flights[key] == f {
+					// Callers arriving later start a new request instead of
+					// joining the cancelled one.
+					f.cancel()
+					group.Forget(key)
+					delete(flights, key)
+				}
+			}
+
+			select {
+			case <-ctx.Done():
+				leave()
+				return nil, ctx.Err()
+
+			case res := <-ch:
+				leave()
+				if res.Err != nil {
+					return nil, res.Err
+				}
+				return res.Val.(*coalescedResponse).copy(req), nil
+			}
+		})
+	}
+}
+
+// flight tracks the callers waiting for a shared request.
+type flight struct {
+	waiters int
+	ctx     context.Context
+	cancel  context.CancelFunc
+}
+
+type coalescedResponse struct {
+	resp *http.Response
+	body []byte
+}
+
+// copy returns a copy of the shared response for one of the callers.
+func (c *coalescedResponse) copy(req *http.Request) *http.Response {
+	resp := *c.resp
+	resp.Header = c.resp.Header.Clone()
+	resp.Trailer = c.resp.Trailer.Clone()
+	resp.Body = ioutil.NopCloser(bytes.NewReader(c.body))
+	if req.Method != "HEAD" {
+		resp.ContentLength = int64(len(c.body))
+	}
+	resp.Request = req
+	return &resp
+}
+
+func coalesceKey(req *http.Request, keyHeaders []string) string {
+	var b strings.Builder
+	b.WriteString(req.Method)
+	b.WriteString(" ")
+	b.WriteString(req.URL.String())
+	for _, name := range keyHeaders {
+		b.WriteString("\n")
+		b.WriteString(name)
+		b.WriteString(": ")
+		b.WriteString(strings.Join(req.Header.Values(name), ", "))
+	}
+	return b.String()
+}
@@ -0,0 +1,191 @@
+package transport_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-chi/transport"
+	"golang.org/x/sync/errgroup"
+)
+
+func TestCoalesce(t *testing.T) {
+	var hits int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		time.Sleep(100 * time.Millisecond)
+		fmt.Fprintf(w, "ok")
+	}))
+	defer server.Close()
+
+	client := &http.Client{
+		Transport: transport.Chain(
+			http.DefaultTransport,
+			transport.Coalesce("Accept"),
+		),
+	}
+
+	t.Run("identical requests", func(t *testing.T) {
+		atomic.StoreInt32(&hits, 0)
+
+		var g errgroup.Group
+		for i := 0; i < 10; i++ {
+			g.Go(func() error {
+				resp, err := client.Get(server.URL)
+				if err != nil {
+					return err
+				}
+				defer resp.Body.Close()
+
+				b, err := ioutil.ReadAll(resp.Body)
+				if err != nil {
+					return err
+				}
+				if string(b) != "ok" {
+					return fmt.Errorf("unexpected response: %q", string(b))
+				}
+				return nil
+			})
+		}
+		if err := g.Wait(); err != nil {
+			t.Fatal(err)
+		}
+
+		if got := atomic.LoadInt32(&hits); got != 1 {
+			t.Fatalf("expected 1 upstream request, got %v", got)
+		}
+	})
+
+	t.Run("cancelled caller", func(t *testing.T) {
+		atomic.StoreInt32(&hits, 0)
+
+		var g errgroup.Group
+		g.Go(func() error {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+			defer cancel()
+
+			req, err := http.NewRequest("GET", server.URL, nil)
+			if err != nil {
+				return err
+			}
+			_, err = client.Do(req.WithContext(ctx))
+			if !errors.Is(err, context.DeadlineExceeded) {
+				return fmt.Errorf("expected deadline exceeded, got %v", err)
+			}
+			return nil
+		})
+		g.Go(func() error {
+			time.Sleep(5 * time.Millisecond)
+
+			resp, err := client.Get(server.URL)
+			if err != nil {
+				return fmt.Errorf("expected the shared request to outlive the cancelled caller: %w", err)
+			}
+			resp.Body.Close()
+			return nil
+		})
+		if err := g.Wait(); err != nil {
+			t.Fatal(err)
+		}
+
+		if got := atomic.LoadInt32(&hits); got != 1 {
+			t.Fatalf("expected 1 upstream request, got %v", got)
+		}
+	})
+
+	t.Run("cancelled request, then new caller", func(t *testing.T) {
+		atomic.StoreInt32(&hits, 0)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+
+		req, err := http.NewRequest("GET", server.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := client.Do(req.WithContext(ctx)); !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("expected deadline exceeded, got %v", err)
+		}
+
+		// The shared request was cancelled, but might not have returned yet.
+		resp, err := client.Get(server.URL)
+		if err != nil {
+			t.Fatalf("expected a new request, not joining the cancelled one: %v", err)
+		}
+		resp.Body.Close()
+
+		if got := atomic.LoadInt32(&hits); got != 2 {
+			t.Fatalf("expected 2 upstream requests, got %v", got)
+		}
+	})
+
+	t.Run("different requests", func(t *testing.T) {
+		atomic.StoreInt32(&hits, 0)
+
+		var g errgroup.Group
+		for _, accept := range []string{"text/plain", "application/json"} {
+			accept := accept
+			g.Go(func() error {
+				req, err := http.NewRequest("GET", server.URL, nil)
+				if err != nil {
+					return err
+				}
+				req.Header.Set("Accept", accept)
+
+				resp, err := client.Do(req)
+				if err != nil {
+					return err
+				}
+				resp.Body.Close()
+				return nil
+			})
+		}
+		if err := g.Wait(); err != nil {
+			t.Fatal(err)
+		}
+
+		if got := atomic.LoadInt32(&hits); got != 2 {
+			t.Fatalf("expected 2 upstream requests, got %v", got)
+		}
+	})
+}
+
+func TestCoalesceConcurrent(t *testing.T) {
+	client := &http.Client{
+		Transport: transport.Chain(
+			transport.RoundTripFunc(func(req *http.Request) (*http.Response, error) {
+				if err := req.Context().Err(); err != nil {
+					return nil, err
+				}
+				return &http.Response{StatusCode: 200, Body: ioutil.NopCloser(strings.NewReader("ok")), Request: req}, nil
+			}),
+			transport.Coalesce(),
+		),
+	}
+
+	// Callers keep arriving while shared requests finish, none of them
+	// may join a finished or cancelled one.
+	var g errgroup.Group
+	for i := 0; i < 200; i++ {
+		g.Go(func() error {
+			for j := 0; j < 200; j++ {
+				resp, err := client.Get("http://example.com")
+				if err != nil {
+					return err
+				}
+				resp.Body.Close()
+			}
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		t.Fatal(err)
+	}
+}
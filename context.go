@@ -0,0 +1,25 @@
+package transport
+
+import (
+	"context"
+	"time"
+)
+
+// detach returns a context with the values of the parent context, which is
+// never cancelled. It's used for work outliving the request, e.g. background
+// refreshes.
+func detach(parent context.Context) context.Context {
+	return detachedContext{parent: parent}
+}
+
+type detachedContext struct {
+	parent context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}       { return nil }
+func (detachedContext) Err() error                  { return nil }
+
+func (c detachedContext) Value(key interface{}) interface{} {
+	return c.parent.Value(key)
+}
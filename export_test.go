@@ -0,0 +1,10 @@
+package transport
+
+import "time"
+
+// SetTimeNow replaces the clock deciding when bearer tokens are refreshed,
+// until restore is called.
+func SetTimeNow(now func() time.Time) (restore func()) {
+	timeNow = now
+	return func() { timeNow = time.Now }
+}
@@ -0,0 +1,252 @@
+package transport
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// HedgeOptions configures a Hedger.
+type HedgeOptions struct {
+	// Delay is how long to wait for response headers before sending
+	// another copy of the request.
+	Delay time.Duration
+
+	// MaxHedges is the maximum number of extra requests sent per request.
+	MaxHedges int
+
+	// Percentile, if set (e.g. 0.95), adapts the delay to the given
+	// percentile of recently observed latencies, so only the slowest
+	// requests get hedged. Delay is used until enough latencies are observed.
+	Percentile float64
+
+	// HedgeIdempotent allows hedging all idempotent requests, i.e. PUT,
+	// DELETE, OPTIONS and TRACE requests and requests carrying an
+	// Idempotency-Key header. By default, only GET and HEAD requests are
+	// hedged, as concurrent copies of a write can race with each other.
+	HedgeIdempotent bool
+}
+
+// HedgeStats reports how a Hedger has been doing.
+type HedgeStats struct {
+	Requests int64 // Requests eligible for hedging.
+	Hedges   int64 // Extra requests sent.
+	Wins     int64 // Requests answered by one of the extra requests.
+}
+
+// Hedger sends duplicate requests to reduce tail latency, see Hedge.
+type Hedger struct {
+	opts HedgeOptions
+
+	mu        sync.Mutex
+	latencies []time.Duration // ring buffer of recent latencies
+	next      int
+
+	requests int64
+	hedges   int64
+	wins     int64
+}
+
+// latencySamples is the number of recent latencies kept for computing
+// the adaptive delay.
+const latencySamples = 128
+
+// NewHedger creates a Hedger. Use its Transport method as a middleware:
+//
+//	hedger := transport.NewHedger(transport.HedgeOptions{
+//	    Delay:      50 * time.Millisecond,
+//	    MaxHedges:  2,
+//	    Percentile: 0.95,
+//	})
+//
+//	client := &http.Client{
+//	    Transport: transport.Chain(http.DefaultTransport, hedger.Transport),
+//	}
+func NewHedger(opts HedgeOptions) *Hedger {
+	return &Hedger{
+		opts:      opts,
+		latencies: make([]time.Duration, 0, latencySamples),
+	}
+}
+
+// Hedge is a middleware that sends a copy of a GET or HEAD request through
+// the rest of the chain if no response headers arrive within delay, up to
+// maxHedges times. The first response wins, the other requests are cancelled.
+// Hedging is no retry mechanism: once all the requests in flight fail,
+// the last error is returned.
+func Hedge(delay time.Duration, maxHedges int) func(http.RoundTripper) http.RoundTripper {
+	return NewHedger(HedgeOptions{Delay: delay, MaxHedges: maxHedges}).Transport
+}
+
+// Stats returns the hedging statistics.
+func (h *Hedger) Stats() HedgeStats {
+	return HedgeStats{
+		Requests: atomic.LoadInt64(&h.requests),
+		Hedges:   atomic.LoadInt64(&h.hedges),
+		Wins:     atomic.LoadInt64(&h.wins),
+	}
+}
+
+type hedgeResult struct {
+	attempt int
+	resp    *http.Response
+	err     error
+	latency time.Duration
+	cancel  context.CancelFunc
+}
+
+// Transport is the hedging middleware.
+func (h *Hedger) Transport(next http.RoundTripper) http.RoundTripper {
+	return RoundTripFunc(func(req *http.Request) (*http.Response, error) {
+		if h.opts.MaxHedges < 1 || !h.hedgeable(req) || (req.Body != nil && req.Body != http.NoBody && req.GetBody == nil) {
+			return next.RoundTrip(req)
+		}
+		atomic.AddInt64(&h.requests, 1)
+
+		ctx := req.Context()
+		results := make(chan hedgeResult, h.opts.MaxHedges+1)
+		cancels := make([]context.CancelFunc, 0, h.opts.MaxHedges+1)
+
+		send := func(attempt int) {
+			attemptCtx, cancel := context.WithCancel(ctx)
+			cancels = append(cancels, cancel)
+
+			go func() {
+				r := req
+				if attempt > 0 {
+					var err error
+					if r, err = rewindBody(req); err != nil {
+						results <- hedgeResult{attempt: attempt, err: err, cancel: cancel}
+						return
+					}
+				}
+
+				startTime := time.Now()
+				resp, err := next.RoundTrip(r.WithContext(attemptCtx))
+				results <- hedgeResult{attempt: attempt, resp: resp, err: err, latency: time.Since(startTime), cancel: cancel}
+			}()
+		}
+
+		sent, pending := 1, 1
+		send(0)
+
+		timer := time.NewTimer(h.delay())
+		defer timer.Stop()
+
+		var lastErr error
+		for {
+			select {
+			case <-ctx.Done():
+				for _, cancel := range cancels {
+					cancel()
+				}
+				go discardResults(results, pending)
+				return nil, ctx.Err()
+
+			case <-timer.C:
+				if sent <= h.opts.MaxHedges {
+					atomic.AddInt64(&h.hedges, 1)
+					send(sent)
+					sent++
+					pending++
+					timer.Reset(h.delay())
+				}
+
+			case res := <-results:
+				pending--
+				if res.err != nil {
+					res.cancel()
+					lastErr = res.err
+					if pending > 0 {
+						continue
+					}
+					// All requests in flight failed. Hedging is no retry
+					// mechanism, so give up.
+					return nil, lastErr
+				}
+
+				// We have a winner. Cancel the other requests and keep
+				// the winner's context alive until its body is closed.
+				for attempt, cancel := range cancels {
+					if attempt != res.attempt {
+						cancel()
+					}
+				}
+				go discardResults(results, pending)
+
+				if res.attempt > 0 {
+					atomic.AddInt64(&h.wins, 1)
+				}
+				h.observe(res.latency)
+
+				res.resp.Body = onClose(res.resp.Body, res.cancel)
+				return res.resp, nil
+			}
+		}
+	})
+}
+
+// hedgeable reports whether copies of the request can be sent.
+func (h *Hedger) hedgeable(req *http.Request) bool {
+	switch req.Method {
+	case "", "GET", "HEAD":
+		return true
+	}
+	return h.opts.HedgeIdempotent && isIdempotent(req)
+}
+
+// discardResults closes the bodies of the n requests that lost the race.
+func discardResults(results <-chan hedgeResult, n int) {
+	for i := 0; i < n; i++ {
+		res := <-results
+		res.cancel()
+		if res.resp != nil {
+			res.resp.Body.Close()
+		}
+	}
+}
+
+// delay returns how long to wait before sending the next hedged request.
+func (h *Hedger) delay() time.Duration {
+	if h.opts.Percentile <= 0 {
+		return h.opts.Delay
+	}
+
+	h.mu.Lock()
+	if len(h.latencies) < latencySamples/4 {
+		h.mu.Unlock()
+		return h.opts.Delay
+	}
+	latencies := append([]time.Duration(nil), h.latencies...)
+	h.mu.Unlock()
+
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	i := int(math.Ceil(h.opts.Percentile*float64(len(latencies)))) - 1
+	if i < 0 {
+		i = 0
+	}
+	if i >= len(latencies) {
+		i = len(latencies) - 1
+	}
+	return latencies[i]
+}
+
+func (h *Hedger) observe(latency time.Duration) {
+	if h.opts.Percentile <= 0 {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if len(h.latencies) < latencySamples {
+		h.latencies = append(h.latencies, latency)
+		return
+	}
+	h.latencies[h.next] = latency
+	h.next = (h.next + 1) % latencySamples
+}
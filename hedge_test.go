@@ -0,0 +1,221 @@
+package transport_test
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-chi/transport"
+)
+
+func TestHedge(t *testing.T) {
+	var hits int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Read the body, so the server notices cancelled requests.
+		io.Copy(ioutil.Discard, r.Body)
+
+		// The first request is stuck, the following ones respond immediately.
+		if atomic.AddInt32(&hits, 1) == 1 {
+			select {
+			case <-r.Context().Done():
+			case <-time.After(5 * time.Second):
+			}
+			return
+		}
+		fmt.Fprintf(w, "ok")
+	}))
+	defer server.Close()
+
+	t.Run("hedge wins", func(t *testing.T) {
+		atomic.StoreInt32(&hits, 0)
+
+		hedger := transport.NewHedger(transport.HedgeOptions{
+			Delay:     20 * time.Millisecond,
+			MaxHedges: 2,
+		})
+		client := &http.Client{
+			Transport: transport.Chain(http.DefaultTransport, hedger.Transport),
+		}
+
+		timeStart := time.Now()
+		resp, err := client.Get(server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		b, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != "ok" {
+			t.Fatalf("unexpected response: %q", string(b))
+		}
+		if elapsed := time.Since(timeStart); elapsed > time.Second {
+			t.Fatalf("expected hedged request to win, but it took %v", elapsed)
+		}
+
+		stats := hedger.Stats()
+		if stats.Requests != 1 || stats.Hedges != 1 || stats.Wins != 1 {
+			t.Fatalf("unexpected stats: %+v", stats)
+		}
+	})
+
+	t.Run("writes are not hedged by default", func(t *testing.T) {
+		hedger := transport.NewHedger(transport.HedgeOptions{
+			Delay:     time.Nanosecond,
+			MaxHedges: 2,
+		})
+		client := &http.Client{
+			Transport: transport.Chain(http.DefaultTransport, hedger.Transport),
+		}
+
+		for _, method := range []string{"POST", "PUT", "DELETE"} {
+			atomic.StoreInt32(&hits, 1) // Don't get stuck.
+
+			req, err := http.NewRequest(method, server.URL, strings.NewReader("data"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Idempotency-Key", "1")
+
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+
+			if got := atomic.LoadInt32(&hits); got != 2 {
+				t.Fatalf("%v: expected 1 request, got %v", method, got-1)
+			}
+		}
+		if stats := hedger.Stats(); stats.Requests != 0 {
+			t.Fatalf("unexpected stats: %+v", stats)
+		}
+	})
+
+	t.Run("PUT requests hedged with HedgeIdempotent", func(t *testing.T) {
+		atomic.StoreInt32(&hits, 0)
+
+		hedger := transport.NewHedger(transport.HedgeOptions{
+			Delay:           20 * time.Millisecond,
+			MaxHedges:       2,
+			HedgeIdempotent: true,
+		})
+		client := &http.Client{
+			Transport: transport.Chain(http.DefaultTransport, hedger.Transport),
+		}
+
+		req, err := http.NewRequest("PUT", server.URL, strings.NewReader("data"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		if stats := hedger.Stats(); stats.Requests != 1 || stats.Wins != 1 {
+			t.Fatalf("unexpected stats: %+v", stats)
+		}
+	})
+}
+
+func TestHedgeErrors(t *testing.T) {
+	var attempts int32
+	hedger := transport.NewHedger(transport.HedgeOptions{
+		Delay:     50 * time.Millisecond,
+		MaxHedges: 2,
+	})
+	client := &http.Client{
+		Transport: transport.Chain(
+			transport.RoundTripFunc(func(req *http.Request) (*http.Response, error) {
+				atomic.AddInt32(&attempts, 1)
+				return nil, errors.New("connection refused")
+			}),
+			hedger.Transport,
+		),
+	}
+
+	if _, err := client.Get("http://example.com"); err == nil {
+		t.Fatal("expected error")
+	}
+
+	if got := atomic.LoadInt32(&attempts); got != 1 {
+		t.Fatalf("expected failed request not to be hedged, got %v attempts", got)
+	}
+	if stats := hedger.Stats(); stats.Hedges != 0 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+}
+
+func TestHedgePercentile(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/stuck" && r.Header.Get("X-Hedged") == "" {
+			select {
+			case <-r.Context().Done():
+			case <-time.After(5 * time.Second):
+			}
+			return
+		}
+		fmt.Fprintf(w, "ok")
+	}))
+	defer server.Close()
+
+	// Delay is only used until enough latencies are observed.
+	hedger := transport.NewHedger(transport.HedgeOptions{
+		Delay:      time.Hour,
+		MaxHedges:  1,
+		Percentile: 0.9,
+	})
+
+	var sent int32
+	markHedged := func(next http.RoundTripper) http.RoundTripper {
+		return transport.RoundTripFunc(func(req *http.Request) (*http.Response, error) {
+			if atomic.AddInt32(&sent, 1) > 1 {
+				req = req.Clone(req.Context())
+				req.Header.Set("X-Hedged", "true")
+			}
+			return next.RoundTrip(req)
+		})
+	}
+	client := &http.Client{
+		Transport: transport.Chain(http.DefaultTransport, hedger.Transport, markHedged),
+	}
+
+	for i := 0; i < 64; i++ {
+		atomic.StoreInt32(&sent, 0)
+		resp, err := client.Get(server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+
+	// Fast requests might get hedged too, only count the stuck one.
+	before := hedger.Stats()
+
+	atomic.StoreInt32(&sent, 0)
+	timeStart := time.Now()
+	resp, err := client.Get(server.URL + "/stuck")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if elapsed := time.Since(timeStart); elapsed > time.Second {
+		t.Fatalf("expected the delay to adapt to observed latencies, but took %v", elapsed)
+	}
+	if stats := hedger.Stats(); stats.Hedges-before.Hedges != 1 || stats.Wins-before.Wins != 1 {
+		t.Fatalf("expected the stuck request to be hedged once, got %+v, before %+v", stats, before)
+	}
+}
@@ -0,0 +1,298 @@
+package transport
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrInvalidSignature is returned when a request or response signature
+// doesn't match, is missing or has expired.
+var ErrInvalidSignature = errors.New("transport: invalid signature")
+
+// HMACComponents selects the parts of a request covered by an HMAC signature.
+type HMACComponents uint
+
+const (
+	HMACMethod     HMACComponents = 1 << iota // Request method.
+	HMACPath                                  // Escaped URL path.
+	HMACQuery                                 // Query parameters, sorted by key.
+	HMACBodyDigest                            // Hex encoded hash of the body.
+	HMACTimestamp                             // Unix time of signing, sent in TimestampHeader.
+
+	// HMACDefaultComponents signs all of the above.
+	HMACDefaultComponents = HMACMethod | HMACPath | HMACQuery | HMACBodyDigest | HMACTimestamp
+)
+
+// HMACCanonicalizer builds the message to sign. The body digest is empty
+// unless HMACBodyDigest is signed, the timestamp header is already set.
+type HMACCanonicalizer func(req *http.Request, bodyDigest string) []byte
+
+// HMACOptions configures HMACSign and VerifyHMAC. Both sides of a service
+// must use the same options.
+type HMACOptions struct {
+	// Key is the shared secret.
+	Key []byte
+
+	// Hash is the hash function, sha256.New by default. Use sha512.New
+	// for HMAC-SHA512.
+	Hash func() hash.Hash
+
+	// Components are the signed parts of the request,
+	// HMACDefaultComponents by default.
+	Components HMACComponents
+
+	// Headers are the names of additional signed headers. "Host" stands
+	// for the request host.
+	Headers []string
+
+	// SignatureHeader is the header carrying the signature,
+	// "X-Signature" by default.
+	SignatureHeader string
+
+	// TimestampHeader is the header carrying the signing time,
+	// "X-Signature-Timestamp" by default.
+	TimestampHeader string
+
+	// Format encodes the signature into the header value, hex by default.
+	// E.g. to send "sha256=<hex>":
+	//
+	//	Format: func(sig []byte) string { return "sha256=" + hex.EncodeToString(sig) },
+	Format func(signature []byte) string
+
+	// Canonicalize, if set, replaces the default canonicalization, which
+	// joins the signed components with newlines.
+	Canonicalize HMACCanonicalizer
+
+	// MaxClockSkew is how old (or how far in the future) a signed timestamp
+	// accepted by VerifyHMAC can be, 5 minutes by default.
+	MaxClockSkew time.Duration
+
+	// MaxBodyBytes is the largest request body VerifyHMAC reads to check
+	// the body digest, 1 MiB by default. Larger bodies fail with
+	// ErrRequestTooLarge.
+	MaxBodyBytes int64
+}
+
+func (o HMACOptions) withDefaults() HMACOptions {
+	if o.Hash == nil {
+		o.Hash = sha256.New
+	}
+	if o.Components == 0 {
+		o.Components = HMACDefaultComponents
+	}
+	if o.SignatureHeader == "" {
+		o.SignatureHeader = "X-Signature"
+	}
+	if o.TimestampHeader == "" {
+		o.TimestampHeader = "X-Signature-Timestamp"
+	}
+	if o.Format == nil {
+		o.Format = hex.EncodeToString
+	}
+	if o.MaxClockSkew <= 0 {
+		o.MaxClockSkew = 5 * time.Minute
+	}
+	if o.MaxBodyBytes <= 0 {
+		o.MaxBodyBytes = 1 << 20
+	}
+	if o.Canonicalize == nil {
+		o.Canonicalize = o.canonicalize
+	}
+	return o
+}
+
+// HMACSign is a middleware signing requests with an HMAC of the request
+// components selected in opts. Servers check the signature with VerifyHMAC.
+//
+//	client := &http.Client{
+//	    Transport: transport.Chain(
+//	        http.DefaultTransport,
+//	        transport.HMACSign(transport.HMACOptions{
+//	            Key:     secret,
+//	            Hash:    sha512.New,
+//	            Headers: []string{"Host", "Content-Type"},
+//	        }),
+//	    ),
+//	}
+//
+// Signing the body digest reads streamed bodies into memory.
+func HMACSign(opts HMACOptions) func(http.RoundTripper) http.RoundTripper {
+	opts = opts.withDefaults()
+
+	return func(next http.RoundTripper) http.RoundTripper {
+		return RoundTripFunc(func(req *http.Request) (*http.Response, error) {
+			r := CloneRequest(req)
+
+			if opts.Components&HMACTimestamp != 0 {
+				r.Header.Set(opts.TimestampHeader, strconv.FormatInt(time.Now().Unix(), 10))
+			}
+
+			var bodyDigest string
+			if opts.Components&HMACBodyDigest != 0 {
+				var body []byte
+				var err error
+				r, body, err = readBody(r)
+				if err != nil {
+					return nil, fmt.Errorf("transport: signing request: %w", err)
+				}
+				bodyDigest = opts.digest(body)
+			}
+
+			r.Header.Set(opts.SignatureHeader, opts.Format(opts.sign(r, bodyDigest)))
+
+			return next.RoundTrip(r)
+		})
+	}
+}
+
+// VerifyHMAC checks the signature of a request signed by HMACSign with
+// the same options. It's meant for servers:
+//
+//	if err := transport.VerifyHMAC(r, opts); err != nil {
+//	    http.Error(w, "invalid signature", http.StatusUnauthorized)
+//	    return
+//	}
+//
+// The body is read into memory and replaced, so it can be read again.
+// Bodies larger than MaxBodyBytes fail with ErrRequestTooLarge, other errors
+// except I/O errors wrap ErrInvalidSignature.
+func VerifyHMAC(req *http.Request, opts HMACOptions) error {
+	opts = opts.withDefaults()
+
+	signature := req.Header.Get(opts.SignatureHeader)
+	if signature == "" {
+		return fmt.Errorf("%w: missing %v header", ErrInvalidSignature, opts.SignatureHeader)
+	}
+
+	if opts.Components&HMACTimestamp != 0 {
+		ts, err := strconv.ParseInt(req.Header.Get(opts.TimestampHeader), 10, 64)
+		if err != nil {
+			return fmt.Errorf("%w: invalid %v header", ErrInvalidSignature, opts.TimestampHeader)
+		}
+		if skew := time.Since(time.Unix(ts, 0)); skew > opts.MaxClockSkew || skew < -opts.MaxClockSkew {
+			return fmt.Errorf("%w: timestamp outside of allowed clock skew", ErrInvalidSignature)
+		}
+	}
+
+	var bodyDigest string
+	if opts.Components&HMACBodyDigest != 0 {
+		var body []byte
+		if req.Body != nil {
+			// The signature is not checked yet, so don't let anybody make
+			// us buffer arbitrarily large bodies.
+			if req.ContentLength > opts.MaxBodyBytes {
+				req.Body.Close()
+				return fmt.Errorf("%w: Content-Length %v exceeds %v bytes", ErrRequestTooLarge, req.ContentLength, opts.MaxBodyBytes)
+			}
+			var err error
+			body, err = ioutil.ReadAll(io.LimitReader(req.Body, opts.MaxBodyBytes+1))
+			req.Body.Close()
+			if err != nil {
+				return err
+			}
+			if int64(len(body)) > opts.MaxBodyBytes {
+				return fmt.Errorf("%w: body exceeds %v bytes", ErrRequestTooLarge, opts.MaxBodyBytes)
+			}
+			req.Body = ioutil.NopCloser(bytes.NewReader(body))
+		}
+		bodyDigest = opts.digest(body)
+	}
+
+	expected := opts.Format(opts.sign(req, bodyDigest))
+	if !hmac.Equal([]byte(signature), []byte(expected)) {
+		return fmt.Errorf("%w: signature mismatch", ErrInvalidSignature)
+	}
+	return nil
+}
+
+func (o HMACOptions) sign(req *http.Request, bodyDigest string) []byte {
+	mac := hmac.New(o.Hash, o.Key)
+	mac.Write(o.Canonicalize(req, bodyDigest))
+	return mac.Sum(nil)
+}
+
+func (o HMACOptions) digest(body []byte) string {
+	h := o.Hash()
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// canonicalize joins the signed components with newlines, headers are
+// written as "name:value".
+func (o HMACOptions) canonicalize(req *http.Request, bodyDigest string) []byte {
+	var lines []string
+	if o.Components&HMACMethod != 0 {
+		lines = append(lines, req.Method)
+	}
+	if o.Components&HMACPath != 0 {
+		lines = append(lines, req.URL.EscapedPath())
+	}
+	if o.Components&HMACQuery != 0 {
+		lines = append(lines, req.URL.Query().Encode())
+	}
+	for _, name := range o.Headers {
+		lines = append(lines, strings.ToLower(name)+":"+headerValue(req, name))
+	}
+	if o.Components&HMACTimestamp != 0 {
+		lines = append(lines, req.Header.Get(o.TimestampHeader))
+	}
+	if o.Components&HMACBodyDigest != 0 {
+		lines = append(lines, bodyDigest)
+	}
+	return []byte(strings.Join(lines, "\n"))
+}
+
+// headerValue returns the comma separated values of the header, or the
+// request host for "Host".
+func headerValue(req *http.Request, name string) string {
+	if strings.EqualFold(name, "Host") {
+		if req.Host != "" {
+			return req.Host
+		}
+		return req.URL.Host
+	}
+	return strings.Join(req.Header.Values(name), ", ")
+}
+
+// readBody reads the whole request body and returns a copy of the request
+// with a replayable body.
+func readBody(req *http.Request) (*http.Request, []byte, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return req, nil, nil
+	}
+
+	var body io.ReadCloser = req.Body
+	if req.GetBody != nil {
+		var err error
+		if body, err = req.GetBody(); err != nil {
+			return nil, nil, err
+		}
+	}
+	buf, err := ioutil.ReadAll(body)
+	body.Close()
+	if err != nil {
+		return nil, nil, err
+	}
+	if req.GetBody != nil {
+		return req, buf, nil
+	}
+
+	r := CloneRequest(req)
+	r.GetBody = func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(buf)), nil
+	}
+	r.Body, _ = r.GetBody()
+	r.ContentLength = int64(len(buf))
+	return r, buf, nil
+}
@@ -0,0 +1,179 @@
+package transport_test
+
+import (
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/transport"
+)
+
+func TestHMACSign(t *testing.T) {
+	tt := []struct {
+		name   string
+		opts   transport.HMACOptions
+		tamper func(req *http.Request)
+		valid  bool
+	}{
+		{
+			name:  "default",
+			opts:  transport.HMACOptions{Key: []byte("secret")},
+			valid: true,
+		},
+		{
+			name: "sha512 with custom header",
+			opts: transport.HMACOptions{
+				Key:             []byte("secret"),
+				Hash:            sha512.New,
+				Headers:         []string{"Host", "Content-Type"},
+				SignatureHeader: "X-Hub-Signature",
+				Format:          func(sig []byte) string { return "sha512=" + hex.EncodeToString(sig) },
+			},
+			valid: true,
+		},
+		{
+			name: "custom canonicalization",
+			opts: transport.HMACOptions{
+				Key: []byte("secret"),
+				Canonicalize: func(req *http.Request, bodyDigest string) []byte {
+					return []byte(req.URL.RequestURI() + "|" + bodyDigest)
+				},
+			},
+			valid: true,
+		},
+		{
+			name: "wrong key",
+			opts: transport.HMACOptions{Key: []byte("secret")},
+			tamper: func(req *http.Request) {
+				req.Header.Set("X-Signature", strings.Repeat("0", 64))
+			},
+		},
+		{
+			name: "tampered query",
+			opts: transport.HMACOptions{Key: []byte("secret")},
+			tamper: func(req *http.Request) {
+				req.URL.RawQuery = "amount=1000"
+			},
+		},
+		{
+			name: "tampered body",
+			opts: transport.HMACOptions{Key: []byte("secret")},
+			tamper: func(req *http.Request) {
+				req.Body = ioutil.NopCloser(strings.NewReader(`{"amount":1000}`))
+				req.ContentLength = -1
+			},
+		},
+		{
+			name: "tampered header",
+			opts: transport.HMACOptions{Key: []byte("secret"), Headers: []string{"Content-Type"}},
+			tamper: func(req *http.Request) {
+				req.Header.Set("Content-Type", "text/plain")
+			},
+		},
+		{
+			name: "unsigned query",
+			opts: transport.HMACOptions{Key: []byte("secret"), Components: transport.HMACMethod | transport.HMACPath},
+			tamper: func(req *http.Request) {
+				req.URL.RawQuery = "amount=1000"
+			},
+			valid: true,
+		},
+		{
+			name: "expired timestamp",
+			opts: transport.HMACOptions{Key: []byte("secret"), MaxClockSkew: time.Minute},
+			tamper: func(req *http.Request) {
+				req.Header.Set("X-Signature-Timestamp", strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10))
+			},
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if err := transport.VerifyHMAC(r, tc.opts); err != nil {
+					if !errors.Is(err, transport.ErrInvalidSignature) {
+						t.Errorf("expected ErrInvalidSignature, got %v", err)
+					}
+					w.WriteHeader(http.StatusUnauthorized)
+					return
+				}
+				io.Copy(w, r.Body)
+			}))
+			defer server.Close()
+
+			tamper := func(next http.RoundTripper) http.RoundTripper {
+				return transport.RoundTripFunc(func(req *http.Request) (*http.Response, error) {
+					if tc.tamper != nil {
+						tc.tamper(req)
+					}
+					return next.RoundTrip(req)
+				})
+			}
+
+			client := &http.Client{
+				Transport: transport.Chain(
+					http.DefaultTransport,
+					transport.HMACSign(tc.opts),
+					tamper,
+				),
+			}
+
+			body := `{"amount":10}`
+			resp, err := client.Post(server.URL+"/payments?amount=10", "application/json", strings.NewReader(body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+
+			b, err := ioutil.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if tc.valid && (resp.StatusCode != 200 || string(b) != body) {
+				t.Fatalf("expected valid signature, got HTTP %v %q", resp.StatusCode, string(b))
+			}
+			if !tc.valid && resp.StatusCode != http.StatusUnauthorized {
+				t.Fatalf("expected invalid signature, got HTTP %v", resp.StatusCode)
+			}
+		})
+	}
+}
+
+func TestVerifyHMACMaxBodyBytes(t *testing.T) {
+	opts := transport.HMACOptions{Key: []byte("secret"), MaxBodyBytes: 10}
+
+	for _, contentLength := range []int64{13, -1} {
+		var signed *http.Request
+		client := &http.Client{
+			Transport: transport.Chain(
+				transport.RoundTripFunc(func(req *http.Request) (*http.Response, error) {
+					signed = req
+					return &http.Response{StatusCode: 200, Body: http.NoBody, Request: req}, nil
+				}),
+				transport.HMACSign(opts),
+			),
+		}
+
+		resp, err := client.Post("http://example.com/payments", "application/json", strings.NewReader(`{"amount":10}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		// Streamed bodies don't announce their size upfront.
+		signed.ContentLength = contentLength
+
+		if err := transport.VerifyHMAC(signed, opts); !errors.Is(err, transport.ErrRequestTooLarge) {
+			t.Errorf("Content-Length %v: expected ErrRequestTooLarge, got %v", contentLength, err)
+		}
+	}
+}
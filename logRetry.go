@@ -0,0 +1,34 @@
+//go:build go1.21
+
+package transport
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// LogRetry logs a retry via log/slog. It's meant to be used as
+// RetryPolicy.OnRetry hook:
+//
+//	transport.RetryWithPolicy(transport.RetryPolicy{
+//	    MaxRetries: 3,
+//	    OnRetry:    transport.LogRetry,
+//	})
+func LogRetry(ctx context.Context, attempt int, req *http.Request, resp *http.Response, err error, wait time.Duration) {
+	attrs := []slog.Attr{
+		slog.String("url", req.URL.String()),
+		slog.Int("attempt", attempt),
+		slog.Duration("wait", wait),
+	}
+	if err != nil {
+		attrs = append(attrs, slog.Any("error", err))
+	}
+	if resp != nil {
+		attrs = append(attrs, slog.Int("status", resp.StatusCode))
+	}
+
+	slog.LogAttrs(ctx, slog.LevelWarn, fmt.Sprintf("Retry request: %v %s", req.Method, req.URL.String()), attrs...)
+}
@@ -0,0 +1,163 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrMaxInFlight is returned by MaxInFlight when a request can't get
+// a slot, because the queue is full or the queue timeout expired.
+var ErrMaxInFlight = errors.New("transport: too many requests in flight")
+
+// MaxInFlightOptions configures the MaxInFlight middleware.
+type MaxInFlightOptions struct {
+	// Limit caps the number of requests in flight. Zero means no limit.
+	Limit int
+
+	// PerHost caps the number of requests in flight per destination host.
+	// Zero means no limit.
+	PerHost int
+
+	// MaxQueue is the maximum number of requests waiting for a slot in each
+	// queue, i.e. the global one and the one of every host. Requests over it
+	// fail with ErrMaxInFlight. Zero means no limit.
+	MaxQueue int
+
+	// QueueTimeout is how long a request waits for its slots, in total,
+	// before failing with ErrMaxInFlight. Zero means waiting until
+	// the request context is done.
+	QueueTimeout time.Duration
+}
+
+// MaxInFlight is a middleware that caps the number of requests in flight
+// to n. Excess requests wait for a slot until the request context is done.
+// A slot is released once the response body is closed, so make sure
+// to always close it.
+func MaxInFlight(n int) func(http.RoundTripper) http.RoundTripper {
+	return MaxInFlightWithOptions(MaxInFlightOptions{Limit: n})
+}
+
+// MaxInFlightWithOptions is like MaxInFlight, but it can also cap requests
+// per host and bound the queue of requests waiting for a slot, isolating
+// slow upstreams from the rest:
+//
+//	transport.MaxInFlightWithOptions(transport.MaxInFlightOptions{
+//	    Limit:        100,
+//	    PerHost:      10,
+//	    MaxQueue:     50,
+//	    QueueTimeout: time.Second,
+//	})
+func MaxInFlightWithOptions(opts MaxInFlightOptions) func(http.RoundTripper) http.RoundTripper {
+	var global *slotQueue
+	if opts.Limit > 0 {
+		global = newSlotQueue(opts.Limit)
+	}
+
+	var mu sync.Mutex
+	hosts := map[string]*slotQueue{}
+
+	hostSlots := func(host string) *slotQueue {
+		if opts.PerHost <= 0 {
+			return nil
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+
+		q, ok := hosts[host]
+		if !ok {
+			q = newSlotQueue(opts.PerHost)
+			hosts[host] = q
+		}
+		return q
+	}
+
+	return func(next http.RoundTripper) http.RoundTripper {
+		return RoundTripFunc(func(req *http.Request) (*http.Response, error) {
+			ctx := req.Context()
+
+			// The queue timeout covers waiting in both queues.
+			var timeout <-chan time.Time
+			if opts.QueueTimeout > 0 {
+				timer := time.NewTimer(opts.QueueTimeout)
+				defer timer.Stop()
+				timeout = timer.C
+			}
+
+			// Take the per-host slot first, so requests to a slow host
+			// don't hold global slots while waiting.
+			host := hostSlots(req.URL.Host)
+			if err := host.acquire(ctx, timeout, opts.MaxQueue); err != nil {
+				return nil, err
+			}
+			if err := global.acquire(ctx, timeout, opts.MaxQueue); err != nil {
+				host.release()
+				return nil, err
+			}
+
+			done := func() {
+				global.release()
+				host.release()
+			}
+
+			resp, err := next.RoundTrip(req)
+			if err != nil || resp.Body == nil {
+				done()
+				return resp, err
+			}
+
+			resp.Body = onClose(resp.Body, done)
+			return resp, nil
+		})
+	}
+}
+
+// slotQueue hands out a limited number of slots. A nil slotQueue means
+// no limit.
+type slotQueue struct {
+	slots  chan struct{}
+	queued int64 // requests waiting for a slot
+}
+
+func newSlotQueue(n int) *slotQueue {
+	return &slotQueue{slots: make(chan struct{}, n)}
+}
+
+// acquire takes a slot, waiting in the queue if needed. Requests over
+// maxQueue (if positive) fail right away.
+func (q *slotQueue) acquire(ctx context.Context, timeout <-chan time.Time, maxQueue int) error {
+	if q == nil {
+		return nil
+	}
+
+	select {
+	case q.slots <- struct{}{}:
+		return nil
+	default:
+	}
+
+	if n := atomic.AddInt64(&q.queued, 1); maxQueue > 0 && n > int64(maxQueue) {
+		atomic.AddInt64(&q.queued, -1)
+		return ErrMaxInFlight
+	}
+	defer atomic.AddInt64(&q.queued, -1)
+
+	select {
+	case q.slots <- struct{}{}:
+		return nil
+	case <-timeout:
+		return ErrMaxInFlight
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (q *slotQueue) release() {
+	if q != nil {
+		<-q.slots
+	}
+}
@@ -0,0 +1,184 @@
+package transport_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/transport"
+)
+
+func TestMaxInFlight(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "ok")
+	}))
+	defer server.Close()
+
+	client := &http.Client{
+		Transport: transport.Chain(
+			http.DefaultTransport,
+			transport.MaxInFlight(1),
+		),
+	}
+
+	first, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The slot is held until the first response body is closed.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	req, err := http.NewRequest("GET", server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = client.Do(req.WithContext(ctx))
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected request to wait for a slot until the deadline, got %v", err)
+	}
+
+	first.Body.Close()
+
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+}
+
+func TestMaxInFlightQueue(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "ok")
+	}))
+	defer server.Close()
+
+	client := &http.Client{
+		Transport: transport.Chain(
+			http.DefaultTransport,
+			transport.MaxInFlightWithOptions(transport.MaxInFlightOptions{
+				PerHost:      1,
+				QueueTimeout: 50 * time.Millisecond,
+			}),
+		),
+	}
+
+	first, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Body.Close()
+
+	timeStart := time.Now()
+	_, err = client.Get(server.URL)
+	if !errors.Is(err, transport.ErrMaxInFlight) {
+		t.Fatalf("expected ErrMaxInFlight, got %v", err)
+	}
+	if elapsed := time.Since(timeStart); elapsed < 50*time.Millisecond {
+		t.Fatalf("expected to wait for 50ms in the queue, but took %v", elapsed)
+	}
+}
+
+func TestMaxInFlightMaxQueue(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "ok")
+	}))
+	defer server.Close()
+
+	client := &http.Client{
+		Transport: transport.Chain(
+			http.DefaultTransport,
+			transport.MaxInFlightWithOptions(transport.MaxInFlightOptions{
+				PerHost:      1,
+				MaxQueue:     1,
+				QueueTimeout: 5 * time.Second,
+			}),
+		),
+	}
+
+	first, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Fill the queue.
+	waiter := make(chan error)
+	go func() {
+		resp, err := client.Get(server.URL)
+		if err == nil {
+			resp.Body.Close()
+		}
+		waiter <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	timeStart := time.Now()
+	_, err = client.Get(server.URL)
+	if !errors.Is(err, transport.ErrMaxInFlight) {
+		t.Fatalf("expected ErrMaxInFlight, got %v", err)
+	}
+	if elapsed := time.Since(timeStart); elapsed > time.Second {
+		t.Fatalf("expected to fail fast with a full queue, but took %v", elapsed)
+	}
+
+	// The queued request gets the slot once it's released.
+	first.Body.Close()
+	if err := <-waiter; err != nil {
+		t.Fatalf("expected the queued request to succeed, got %v", err)
+	}
+}
+
+func TestMaxInFlightQueueTimeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "ok")
+	}))
+	defer server.Close()
+
+	client := &http.Client{
+		Transport: transport.Chain(
+			http.DefaultTransport,
+			transport.MaxInFlightWithOptions(transport.MaxInFlightOptions{
+				Limit:        1,
+				PerHost:      1,
+				QueueTimeout: 100 * time.Millisecond,
+			}),
+		),
+	}
+
+	// Hold the only global slot.
+	other, err := client.Get(strings.Replace(server.URL, "127.0.0.1", "localhost", 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Body.Close()
+
+	// Hold the host slot, while waiting for the global one.
+	waiter := make(chan *http.Response)
+	go func() {
+		resp, _ := client.Get(server.URL)
+		waiter <- resp
+	}()
+	defer func() {
+		if resp := <-waiter; resp != nil {
+			resp.Body.Close()
+		}
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	// Wait for the host slot, then for the global slot.
+	timeStart := time.Now()
+	_, err = client.Get(server.URL)
+	if !errors.Is(err, transport.ErrMaxInFlight) {
+		t.Fatalf("expected ErrMaxInFlight, got %v", err)
+	}
+	if elapsed := time.Since(timeStart); elapsed > 150*time.Millisecond {
+		t.Fatalf("expected to wait for 100ms in both queues in total, but took %v", elapsed)
+	}
+}
@@ -0,0 +1,57 @@
+package transport
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+)
+
+// ErrRequestTooLarge is returned by MaxRequestBytes when the request body
+// is larger than the limit.
+var ErrRequestTooLarge = errors.New("transport: request body too large")
+
+// MaxRequestBytes is a middleware rejecting requests with bodies larger than
+// n bytes before anything is sent upstream. Bodies of unknown length are read
+// into memory (up to n bytes) to find out their size.
+func MaxRequestBytes(n int64) func(http.RoundTripper) http.RoundTripper {
+	return func(next http.RoundTripper) http.RoundTripper {
+		return RoundTripFunc(func(req *http.Request) (*http.Response, error) {
+			if req.Body == nil || req.Body == http.NoBody {
+				return next.RoundTrip(req)
+			}
+
+			if req.ContentLength > n {
+				req.Body.Close()
+				return nil, fmt.Errorf("%w: Content-Length %v exceeds %v bytes", ErrRequestTooLarge, req.ContentLength, n)
+			}
+			if req.ContentLength > 0 {
+				return next.RoundTrip(req)
+			}
+
+			// Streamed body of unknown length.
+			buf, err := ioutil.ReadAll(io.LimitReader(req.Body, n+1))
+			req.Body.Close()
+			if err != nil {
+				return nil, err
+			}
+			if int64(len(buf)) > n {
+				return nil, fmt.Errorf("%w: body exceeds %v bytes", ErrRequestTooLarge, n)
+			}
+
+			r := CloneRequest(req)
+			r.ContentLength = int64(len(buf))
+			r.GetBody = func() (io.ReadCloser, error) {
+				return ioutil.NopCloser(bytes.NewReader(buf)), nil
+			}
+			r.Body, _ = r.GetBody()
+			if len(buf) == 0 {
+				r.Body = http.NoBody
+			}
+
+			return next.RoundTrip(r)
+		})
+	}
+}
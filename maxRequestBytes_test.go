@@ -0,0 +1,64 @@
+package transport_test
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/go-chi/transport"
+)
+
+func TestMaxRequestBytes(t *testing.T) {
+	var hits int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+
+		b, err := ioutil.ReadAll(r.Body)
+		if err != nil || len(b) != 100 {
+			t.Errorf("unexpected body (%v bytes): %v", len(b), err)
+		}
+	}))
+	defer server.Close()
+
+	tt := []struct {
+		name     string
+		body     func() io.Reader
+		limit    int64
+		expected error
+	}{
+		{"known length", func() io.Reader { return strings.NewReader(strings.Repeat("x", 100)) }, 100, nil},
+		{"streamed", func() io.Reader { return io.MultiReader(strings.NewReader(strings.Repeat("x", 100))) }, 100, nil},
+		{"known length over limit", func() io.Reader { return strings.NewReader(strings.Repeat("x", 100)) }, 99, transport.ErrRequestTooLarge},
+		{"streamed over limit", func() io.Reader { return io.MultiReader(strings.NewReader(strings.Repeat("x", 100))) }, 99, transport.ErrRequestTooLarge},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			atomic.StoreInt32(&hits, 0)
+
+			client := &http.Client{
+				Transport: transport.Chain(
+					http.DefaultTransport,
+					transport.MaxRequestBytes(tc.limit),
+				),
+			}
+
+			resp, err := client.Post(server.URL, "text/plain", tc.body())
+			if err == nil {
+				resp.Body.Close()
+			}
+
+			if !errors.Is(err, tc.expected) {
+				t.Fatalf("expected %v, got %v", tc.expected, err)
+			}
+			if tc.expected != nil && atomic.LoadInt32(&hits) != 0 {
+				t.Fatal("expected the request not to be sent")
+			}
+		})
+	}
+}
@@ -0,0 +1,66 @@
+package transport
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// ErrResponseTooLarge is returned by MaxResponseBytes when the response body
+// is larger than the limit.
+var ErrResponseTooLarge = errors.New("transport: response body too large")
+
+// MaxResponseBytes is a middleware limiting the size of response bodies
+// to n bytes. Responses with larger Content-Length fail right away, other
+// response bodies fail with ErrResponseTooLarge once read past the limit.
+func MaxResponseBytes(n int64) func(http.RoundTripper) http.RoundTripper {
+	return func(next http.RoundTripper) http.RoundTripper {
+		return RoundTripFunc(func(req *http.Request) (*http.Response, error) {
+			resp, err := next.RoundTrip(req)
+			if err != nil {
+				return nil, err
+			}
+
+			// Responses without a body report the size of the resource
+			// they describe, e.g. to HEAD requests.
+			bodyless := req.Method == "HEAD" || resp.Body == http.NoBody ||
+				resp.StatusCode == http.StatusNoContent || resp.StatusCode == http.StatusNotModified
+
+			if resp.ContentLength > n && !bodyless {
+				resp.Body.Close()
+				return nil, fmt.Errorf("%w: Content-Length %v exceeds %v bytes", ErrResponseTooLarge, resp.ContentLength, n)
+			}
+
+			resp.Body = &maxBytesBody{ReadCloser: resp.Body, remaining: n}
+			return resp, nil
+		})
+	}
+}
+
+// maxBytesBody fails with ErrResponseTooLarge once more than the remaining
+// bytes are read.
+type maxBytesBody struct {
+	io.ReadCloser
+	remaining int64
+}
+
+func (b *maxBytesBody) Read(p []byte) (int, error) {
+	if b.remaining < 0 {
+		return 0, ErrResponseTooLarge
+	}
+
+	// Read one byte more than allowed to tell whether the body is too large.
+	if int64(len(p)) > b.remaining+1 {
+		p = p[:b.remaining+1]
+	}
+	n, err := b.ReadCloser.Read(p)
+
+	if int64(n) > b.remaining {
+		n = int(b.remaining)
+		b.remaining = -1
+		return n, ErrResponseTooLarge
+	}
+	b.remaining -= int64(n)
+	return n, err
+}
@@ -0,0 +1,74 @@
+package transport_test
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/transport"
+)
+
+func TestMaxResponseBytes(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := strings.Repeat("x", 100)
+		if r.URL.Path == "/streamed" {
+			// Flush before writing the body, so Content-Length is not known.
+			w.(http.Flusher).Flush()
+		}
+		io.WriteString(w, body)
+	}))
+	defer server.Close()
+
+	tt := []struct {
+		path     string
+		limit    int64
+		expected error
+	}{
+		{"/", 100, nil},
+		{"/streamed", 100, nil},
+		{"/", 99, transport.ErrResponseTooLarge},
+		{"/streamed", 99, transport.ErrResponseTooLarge},
+	}
+
+	for _, tc := range tt {
+		client := &http.Client{
+			Transport: transport.Chain(
+				http.DefaultTransport,
+				transport.MaxResponseBytes(tc.limit),
+			),
+		}
+
+		resp, err := client.Get(server.URL + tc.path)
+		if err == nil {
+			_, err = ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+		}
+
+		if !errors.Is(err, tc.expected) {
+			t.Errorf("%v with %v bytes limit: expected %v, got %v", tc.path, tc.limit, tc.expected, err)
+		}
+	}
+
+	t.Run("HEAD", func(t *testing.T) {
+		client := &http.Client{
+			Transport: transport.Chain(
+				http.DefaultTransport,
+				transport.MaxResponseBytes(10),
+			),
+		}
+
+		resp, err := client.Head(server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		if resp.ContentLength != 100 {
+			t.Fatalf("expected Content-Length of the resource, got %v", resp.ContentLength)
+		}
+	})
+}
@@ -0,0 +1,762 @@
+package transport
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SignatureKey signs and verifies HTTP message signatures (RFC 9421).
+// Use NewSignatureKey for the common key types, or implement it to sign
+// with keys held elsewhere, e.g. in a KMS.
+type SignatureKey interface {
+	// KeyID is sent in the keyid signature parameter.
+	KeyID() string
+
+	// Algorithm is the registered algorithm name, e.g. "ed25519".
+	Algorithm() string
+
+	Sign(message []byte) ([]byte, error)
+	Verify(message, signature []byte) error
+}
+
+// NewSignatureKey creates a SignatureKey from one of:
+//
+//	ed25519.PrivateKey, ed25519.PublicKey      // "ed25519"
+//	*ecdsa.PrivateKey, *ecdsa.PublicKey (P-256) // "ecdsa-p256-sha256"
+//	[]byte                                      // "hmac-sha256" shared secret
+//
+// Public keys can only verify signatures.
+func NewSignatureKey(keyID string, key interface{}) (SignatureKey, error) {
+	switch k := key.(type) {
+	case ed25519.PrivateKey:
+		return &ed25519Key{id: keyID, private: k, public: k.Public().(ed25519.PublicKey)}, nil
+	case ed25519.PublicKey:
+		return &ed25519Key{id: keyID, public: k}, nil
+	case *ecdsa.PrivateKey:
+		if k.Curve != elliptic.P256() {
+			return nil, fmt.Errorf("transport: unsupported ECDSA curve %v", k.Curve.Params().Name)
+		}
+		return &ecdsaKey{id: keyID, private: k, public: &k.PublicKey}, nil
+	case *ecdsa.PublicKey:
+		if k.Curve != elliptic.P256() {
+			return nil, fmt.Errorf("transport: unsupported ECDSA curve %v", k.Curve.Params().Name)
+		}
+		return &ecdsaKey{id: keyID, public: k}, nil
+	case []byte:
+		return &hmacKey{id: keyID, secret: k}, nil
+	default:
+		return nil, fmt.Errorf("transport: unsupported signature key type %T", key)
+	}
+}
+
+var errPublicKey = errors.New("transport: can't sign with a public key")
+
+type ed25519Key struct {
+	id      string
+	private ed25519.PrivateKey
+	public  ed25519.PublicKey
+}
+
+func (k *ed25519Key) KeyID() string     { return k.id }
+func (k *ed25519Key) Algorithm() string { return "ed25519" }
+
+func (k *ed25519Key) Sign(message []byte) ([]byte, error) {
+	if k.private == nil {
+		return nil, errPublicKey
+	}
+	return ed25519.Sign(k.private, message), nil
+}
+
+func (k *ed25519Key) Verify(message, signature []byte) error {
+	if !ed25519.Verify(k.public, message, signature) {
+		return fmt.Errorf("%w: signature mismatch", ErrInvalidSignature)
+	}
+	return nil
+}
+
+// ecdsaKey signs with ECDSA P-256 and SHA-256. Signatures are the raw
+// big-endian r and s values, 32 bytes each.
+type ecdsaKey struct {
+	id      string
+	private *ecdsa.PrivateKey
+	public  *ecdsa.PublicKey
+}
+
+func (k *ecdsaKey) KeyID() string     { return k.id }
+func (k *ecdsaKey) Algorithm() string { return "ecdsa-p256-sha256" }
+
+func (k *ecdsaKey) Sign(message []byte) ([]byte, error) {
+	if k.private == nil {
+		return nil, errPublicKey
+	}
+	digest := sha256.Sum256(message)
+	r, s, err := ecdsa.Sign(rand.Reader, k.private, digest[:])
+	if err != nil {
+		return nil, err
+	}
+
+	// Left-pad r and s to 32 bytes each.
+	signature := make([]byte, 64)
+	rb, sb := r.Bytes(), s.Bytes()
+	copy(signature[32-len(rb):32], rb)
+	copy(signature[64-len(sb):], sb)
+	return signature, nil
+}
+
+func (k *ecdsaKey) Verify(message, signature []byte) error {
+	if len(signature) != 64 {
+		return fmt.Errorf("%w: invalid ECDSA signature length", ErrInvalidSignature)
+	}
+	digest := sha256.Sum256(message)
+	r := new(big.Int).SetBytes(signature[:32])
+	s := new(big.Int).SetBytes(signature[32:])
+	if !ecdsa.Verify(k.public, digest[:], r, s) {
+		return fmt.Errorf("%w: signature mismatch", ErrInvalidSignature)
+	}
+	return nil
+}
+
+type hmacKey struct {
+	id     string
+	secret []byte
+}
+
+func (k *hmacKey) KeyID() string     { return k.id }
+func (k *hmacKey) Algorithm() string { return "hmac-sha256" }
+
+func (k *hmacKey) Sign(message []byte) ([]byte, error) {
+	mac := hmac.New(sha256.New, k.secret)
+	mac.Write(message)
+	return mac.Sum(nil), nil
+}
+
+func (k *hmacKey) Verify(message, signature []byte) error {
+	expected, _ := k.Sign(message)
+	if !hmac.Equal(expected, signature) {
+		return fmt.Errorf("%w: signature mismatch", ErrInvalidSignature)
+	}
+	return nil
+}
+
+// MessageSignatureOptions configures SignRequests and SignResponse.
+type MessageSignatureOptions struct {
+	// Key signs the messages.
+	Key SignatureKey
+
+	// Label names the signature in the Signature-Input and Signature
+	// headers, "sig" by default.
+	Label string
+
+	// Components are the covered component identifiers: derived components
+	// ("@method", "@target-uri", "@authority", "@scheme", "@request-target",
+	// "@path", "@query", "@status") and lowercase header names. The "req"
+	// parameter (e.g. "@method;req") refers to the request of a response.
+	//
+	// Requests cover "@method", "@target-uri" and "@authority" by default,
+	// responses cover "@status".
+	Components []string
+
+	// Expires, if set, limits how long the signature is valid.
+	Expires time.Duration
+
+	// Tag is an optional application-specific tag parameter.
+	Tag string
+}
+
+// MessageVerifyOptions configures VerifyRequestSignature,
+// VerifyResponseSignature and VerifyResponses.
+type MessageVerifyOptions struct {
+	// Key verifies the signature. Signatures with a different keyid or alg
+	// parameter are rejected.
+	Key SignatureKey
+
+	// Label selects the signature to verify. Defaults to the first one.
+	Label string
+
+	// RequiredComponents must be covered by the signature.
+	RequiredComponents []string
+
+	// MaxAge, if set, rejects signatures created longer ago.
+	MaxAge time.Duration
+}
+
+// SignRequests is a middleware signing requests with HTTP Message Signatures
+// (RFC 9421), setting the Signature-Input and Signature headers.
+//
+//	key, err := transport.NewSignatureKey("my-key", ed25519PrivateKey)
+//	if err != nil {
+//	    return err
+//	}
+//
+//	client := &http.Client{
+//	    Transport: transport.Chain(
+//	        http.DefaultTransport,
+//	        transport.SignRequests(transport.MessageSignatureOptions{
+//	            Key:        key,
+//	            Components: []string{"@method", "@target-uri", "@authority", "content-type"},
+//	        }),
+//	    ),
+//	}
+//
+// Signatures already present on the request are kept.
+func SignRequests(opts MessageSignatureOptions) func(http.RoundTripper) http.RoundTripper {
+	if len(opts.Components) == 0 {
+		opts.Components = []string{"@method", "@target-uri", "@authority"}
+	}
+
+	return func(next http.RoundTripper) http.RoundTripper {
+		return RoundTripFunc(func(req *http.Request) (*http.Response, error) {
+			r := CloneRequest(req)
+
+			if err := signMessage(signedMessage{req: r}, r.Header, opts); err != nil {
+				if req.Body != nil {
+					req.Body.Close()
+				}
+				return nil, fmt.Errorf("transport: signing request: %w", err)
+			}
+
+			return next.RoundTrip(r)
+		})
+	}
+}
+
+// SignResponse adds an HTTP message signature (RFC 9421) to the response,
+// e.g. in a proxy. The response must have its Request set to sign
+// components with the "req" parameter.
+func SignResponse(resp *http.Response, opts MessageSignatureOptions) error {
+	if len(opts.Components) == 0 {
+		opts.Components = []string{"@status"}
+	}
+	return signMessage(signedMessage{req: resp.Request, resp: resp}, resp.Header, opts)
+}
+
+// VerifyRequestSignature checks the HTTP message signature (RFC 9421) of
+// an incoming request. Errors wrap ErrInvalidSignature.
+func VerifyRequestSignature(req *http.Request, opts MessageVerifyOptions) error {
+	return verifyMessage(signedMessage{req: req}, req.Header, opts)
+}
+
+// VerifyResponseSignature checks the HTTP message signature (RFC 9421) of
+// a response. Errors wrap ErrInvalidSignature.
+func VerifyResponseSignature(resp *http.Response, opts MessageVerifyOptions) error {
+	return verifyMessage(signedMessage{req: resp.Request, resp: resp}, resp.Header, opts)
+}
+
+// VerifyResponses is a middleware failing requests whose responses are not
+// signed as required by opts, see VerifyResponseSignature.
+func VerifyResponses(opts MessageVerifyOptions) func(http.RoundTripper) http.RoundTripper {
+	return func(next http.RoundTripper) http.RoundTripper {
+		return RoundTripFunc(func(req *http.Request) (*http.Response, error) {
+			resp, err := next.RoundTrip(req)
+			if err != nil {
+				return resp, err
+			}
+			if resp.Request == nil {
+				resp.Request = req
+			}
+
+			if err := VerifyResponseSignature(resp, opts); err != nil {
+				drainBody(resp)
+				return nil, err
+			}
+			return resp, nil
+		})
+	}
+}
+
+// signedMessage is a request, or a response together with its request.
+type signedMessage struct {
+	req  *http.Request
+	resp *http.Response
+}
+
+// component is a covered component identifier, e.g. "@method" with
+// params ";req".
+type component struct {
+	name   string
+	params string
+}
+
+func parseComponent(s string) component {
+	name, params := s, ""
+	if i := strings.IndexByte(s, ';'); i >= 0 {
+		name, params = s[:i], s[i:]
+	}
+	return component{name: strings.ToLower(name), params: params}
+}
+
+func (c component) String() string {
+	return sfString(c.name) + c.params
+}
+
+func (c component) hasParam(param string) bool {
+	for _, p := range strings.Split(c.params, ";") {
+		if p == param {
+			return true
+		}
+	}
+	return false
+}
+
+// value returns the component value of the message.
+func (m signedMessage) value(c component) (string, error) {
+	for _, p := range strings.Split(c.params, ";")[1:] {
+		if p != "req" {
+			return "", fmt.Errorf("unsupported component parameter %q", p)
+		}
+	}
+
+	// Response components are taken from the response, unless they have
+	// the req parameter.
+	req, header := m.req, http.Header(nil)
+	if m.resp != nil && !c.hasParam("req") {
+		if strings.HasPrefix(c.name, "@") && c.name != "@status" {
+			return "", fmt.Errorf("%v: request components of a response need the req parameter", c)
+		}
+		header = m.resp.Header
+	} else {
+		if req == nil {
+			return "", fmt.Errorf("%v: no request", c)
+		}
+		header = req.Header
+	}
+
+	switch c.name {
+	case "@method":
+		return req.Method, nil
+	case "@target-uri":
+		return messageScheme(req) + "://" + messageAuthority(req) + req.URL.RequestURI(), nil
+	case "@authority":
+		return messageAuthority(req), nil
+	case "@scheme":
+		return messageScheme(req), nil
+	case "@request-target":
+		return req.URL.RequestURI(), nil
+	case "@path":
+		if path := req.URL.EscapedPath(); path != "" {
+			return path, nil
+		}
+		return "/", nil
+	case "@query":
+		return "?" + req.URL.RawQuery, nil
+	case "@status":
+		if m.resp == nil || c.hasParam("req") {
+			return "", fmt.Errorf("%v: not a response", c)
+		}
+		return strconv.Itoa(m.resp.StatusCode), nil
+	}
+	if strings.HasPrefix(c.name, "@") {
+		return "", fmt.Errorf("unsupported derived component %v", c)
+	}
+
+	var values []string
+	if c.name == "host" && header.Get("Host") == "" && (m.resp == nil || c.hasParam("req")) {
+		values = []string{messageAuthority(req)}
+	} else {
+		values = header.Values(c.name)
+	}
+	if len(values) == 0 {
+		return "", fmt.Errorf("missing header %v", c)
+	}
+	for i, v := range values {
+		values[i] = strings.TrimSpace(v)
+	}
+	return strings.Join(values, ", "), nil
+}
+
+func messageScheme(req *http.Request) string {
+	if req.URL.Scheme != "" {
+		return strings.ToLower(req.URL.Scheme)
+	}
+	if req.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+// messageAuthority returns the lowercase host of the request, without
+// the default port of the scheme.
+func messageAuthority(req *http.Request) string {
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	host = strings.ToLower(host)
+
+	switch scheme := messageScheme(req); {
+	case scheme == "https" && strings.HasSuffix(host, ":443"):
+		return strings.TrimSuffix(host, ":443")
+	case scheme == "http" && strings.HasSuffix(host, ":80"):
+		return strings.TrimSuffix(host, ":80")
+	}
+	return host
+}
+
+// signatureBase builds the signed message of RFC 9421 section 2.5.
+func signatureBase(m signedMessage, components []component, signatureParams string) ([]byte, error) {
+	var b strings.Builder
+	for _, c := range components {
+		value, err := m.value(c)
+		if err != nil {
+			return nil, err
+		}
+		b.WriteString(c.String())
+		b.WriteString(": ")
+		b.WriteString(value)
+		b.WriteByte('\n')
+	}
+	b.WriteString(`"@signature-params": `)
+	b.WriteString(signatureParams)
+	return []byte(b.String()), nil
+}
+
+func signMessage(m signedMessage, header http.Header, opts MessageSignatureOptions) error {
+	if opts.Key == nil {
+		return errors.New("no signature key")
+	}
+	label := opts.Label
+	if label == "" {
+		label = "sig"
+	}
+
+	components := make([]component, len(opts.Components))
+	identifiers := make([]string, len(opts.Components))
+	for i, s := range opts.Components {
+		components[i] = parseComponent(s)
+		identifiers[i] = components[i].String()
+	}
+
+	now := time.Now()
+	params := fmt.Sprintf("(%s);created=%d", strings.Join(identifiers, " "), now.Unix())
+	if opts.Expires > 0 {
+		params += fmt.Sprintf(";expires=%d", now.Add(opts.Expires).Unix())
+	}
+	if keyID := opts.Key.KeyID(); keyID != "" {
+		params += ";keyid=" + sfString(keyID)
+	}
+	params += ";alg=" + sfString(opts.Key.Algorithm())
+	if opts.Tag != "" {
+		params += ";tag=" + sfString(opts.Tag)
+	}
+
+	base, err := signatureBase(m, components, params)
+	if err != nil {
+		return err
+	}
+	signature, err := opts.Key.Sign(base)
+	if err != nil {
+		return err
+	}
+
+	addDictionaryMember(header, "Signature-Input", label+"="+params)
+	addDictionaryMember(header, "Signature", label+"=:"+base64.StdEncoding.EncodeToString(signature)+":")
+	return nil
+}
+
+func verifyMessage(m signedMessage, header http.Header, opts MessageVerifyOptions) error {
+	if opts.Key == nil {
+		return fmt.Errorf("%w: no verification key", ErrInvalidSignature)
+	}
+
+	inputs, err := parseSignatureInput(strings.Join(header.Values("Signature-Input"), ", "))
+	if err != nil {
+		return fmt.Errorf("%w: Signature-Input: %v", ErrInvalidSignature, err)
+	}
+
+	var input *signatureInput
+	for i := range inputs {
+		if opts.Label == "" || inputs[i].label == opts.Label {
+			input = &inputs[i]
+			break
+		}
+	}
+	if input == nil {
+		return fmt.Errorf("%w: missing signature", ErrInvalidSignature)
+	}
+
+	signature, err := signatureValue(strings.Join(header.Values("Signature"), ", "), input.label)
+	if err != nil {
+		return fmt.Errorf("%w: Signature: %v", ErrInvalidSignature, err)
+	}
+
+	for _, required := range opts.RequiredComponents {
+		c, covered := parseComponent(required), false
+		for _, ic := range input.components {
+			covered = covered || ic == c
+		}
+		if !covered {
+			return fmt.Errorf("%w: %v not covered", ErrInvalidSignature, c)
+		}
+	}
+
+	if keyID, ok := input.params.get("keyid"); ok && keyID != opts.Key.KeyID() {
+		return fmt.Errorf("%w: unknown keyid %q", ErrInvalidSignature, keyID)
+	}
+	if alg, ok := input.params.get("alg"); ok && alg != opts.Key.Algorithm() {
+		return fmt.Errorf("%w: unexpected alg %q", ErrInvalidSignature, alg)
+	}
+	now := time.Now()
+	if expires, ok := input.params.get("expires"); ok {
+		t, err := strconv.ParseInt(expires, 10, 64)
+		if err != nil || now.Unix() > t {
+			return fmt.Errorf("%w: expired", ErrInvalidSignature)
+		}
+	}
+	if opts.MaxAge > 0 {
+		created, _ := input.params.get("created")
+		t, err := strconv.ParseInt(created, 10, 64)
+		if err != nil || now.Sub(time.Unix(t, 0)) > opts.MaxAge {
+			return fmt.Errorf("%w: created too long ago", ErrInvalidSignature)
+		}
+	}
+
+	// The signature parameters are serialized again (RFC 9421 section 2.3),
+	// not copied from the header, which might not be in canonical form.
+	base, err := signatureBase(m, input.components, input.serialize())
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidSignature, err)
+	}
+	return opts.Key.Verify(base, signature)
+}
+
+// addDictionaryMember adds a member to a structured field dictionary header.
+func addDictionaryMember(header http.Header, name string, member string) {
+	if v := header.Get(name); v != "" {
+		member = v + ", " + member
+	}
+	header.Set(name, member)
+}
+
+// sfString serializes a structured field string.
+func sfString(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+// signatureInput is a parsed member of the Signature-Input header.
+type signatureInput struct {
+	label      string
+	components []component
+	params     sfParams
+}
+
+// serialize returns the canonical form of the inner list with parameters,
+// used as the "@signature-params" value.
+func (in signatureInput) serialize() string {
+	identifiers := make([]string, len(in.components))
+	for i, c := range in.components {
+		identifiers[i] = c.String()
+	}
+	return "(" + strings.Join(identifiers, " ") + ")" + in.params.String()
+}
+
+// parseSignatureInput parses the Signature-Input dictionary, whose members
+// are inner lists of strings, e.g.
+//
+//	sig1=("@method" "@authority";req);created=1618884473;keyid="key"
+func parseSignatureInput(s string) ([]signatureInput, error) {
+	p := &sfParser{s: s}
+
+	var inputs []signatureInput
+	for {
+		p.skipSpaces()
+		if p.done() {
+			return inputs, nil
+		}
+
+		label := p.key()
+		if label == "" || !p.consume('=') || !p.consume('(') {
+			return nil, p.errorf("expected label=(...)")
+		}
+		in := signatureInput{label: label}
+		for {
+			p.skipSpaces()
+			if p.consume(')') {
+				break
+			}
+			name, ok := p.quoted()
+			if !ok {
+				return nil, p.errorf("expected component identifier")
+			}
+			params, err := p.params()
+			if err != nil {
+				return nil, err
+			}
+			in.components = append(in.components, component{name: name, params: params.String()})
+		}
+
+		params, err := p.params()
+		if err != nil {
+			return nil, err
+		}
+		in.params = params
+		inputs = append(inputs, in)
+
+		p.skipSpaces()
+		if !p.done() && !p.consume(',') {
+			return nil, p.errorf("expected ','")
+		}
+	}
+}
+
+// signatureValue returns the signature with the label from the Signature
+// dictionary, e.g. sig1=:base64:.
+func signatureValue(s string, label string) ([]byte, error) {
+	for _, member := range strings.Split(s, ",") {
+		kv := strings.SplitN(strings.TrimSpace(member), "=", 2)
+		if len(kv) != 2 || kv[0] != label {
+			continue
+		}
+
+		value := kv[1]
+		if i := strings.IndexByte(value, ';'); i >= 0 {
+			value = value[:i]
+		}
+		if len(value) < 2 || value[0] != ':' || value[len(value)-1] != ':' {
+			return nil, fmt.Errorf("expected byte sequence")
+		}
+		return base64.StdEncoding.DecodeString(value[1 : len(value)-1])
+	}
+	return nil, fmt.Errorf("missing signature %q", label)
+}
+
+// sfParser parses the subset of structured fields (RFC 8941) used by
+// the Signature-Input header.
+type sfParser struct {
+	s   string
+	pos int
+}
+
+func (p *sfParser) done() bool { return p.pos >= len(p.s) }
+
+func (p *sfParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("at offset %v: "+format, append([]interface{}{p.pos}, args...)...)
+}
+
+func (p *sfParser) skipSpaces() {
+	for !p.done() && (p.s[p.pos] == ' ' || p.s[p.pos] == '\t') {
+		p.pos++
+	}
+}
+
+func (p *sfParser) consume(c byte) bool {
+	if !p.done() && p.s[p.pos] == c {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+// key parses a dictionary or parameter key.
+func (p *sfParser) key() string {
+	start := p.pos
+	for !p.done() {
+		c := p.s[p.pos]
+		if !('a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '_' || c == '-' || c == '.' || c == '*') {
+			break
+		}
+		p.pos++
+	}
+	return p.s[start:p.pos]
+}
+
+// quoted parses a quoted string.
+func (p *sfParser) quoted() (string, bool) {
+	if !p.consume('"') {
+		return "", false
+	}
+	var b strings.Builder
+	for !p.done() {
+		c := p.s[p.pos]
+		p.pos++
+		switch c {
+		case '"':
+			return b.String(), true
+		case '\\':
+			if p.done() {
+				return "", false
+			}
+			b.WriteByte(p.s[p.pos])
+			p.pos++
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return "", false
+}
+
+// sfParam is a parameter of a structured field item.
+type sfParam struct {
+	key      string
+	value    string // unquoted for strings, "?1" for true
+	isString bool
+}
+
+type sfParams []sfParam
+
+func (ps sfParams) get(key string) (string, bool) {
+	for _, p := range ps {
+		if p.key == key {
+			return p.value, true
+		}
+	}
+	return "", false
+}
+
+// String serializes the parameters in canonical form.
+func (ps sfParams) String() string {
+	var b strings.Builder
+	for _, p := range ps {
+		b.WriteByte(';')
+		b.WriteString(p.key)
+		switch {
+		case p.isString:
+			b.WriteByte('=')
+			b.WriteString(sfString(p.value))
+		case p.value != "?1":
+			b.WriteByte('=')
+			b.WriteString(p.value)
+		}
+	}
+	return b.String()
+}
+
+// params parses parameters. Values are integers, strings, tokens
+// or booleans.
+func (p *sfParser) params() (sfParams, error) {
+	var params sfParams
+	for p.consume(';') {
+		p.skipSpaces()
+		param := sfParam{key: p.key(), value: "?1"}
+		if param.key == "" {
+			return nil, p.errorf("expected parameter key")
+		}
+
+		if p.consume('=') {
+			if str, ok := p.quoted(); ok {
+				param.value, param.isString = str, true
+			} else {
+				valueStart := p.pos
+				for !p.done() && !strings.ContainsRune(" \t;,()", rune(p.s[p.pos])) {
+					p.pos++
+				}
+				if param.value = p.s[valueStart:p.pos]; param.value == "" {
+					return nil, p.errorf("expected parameter value")
+				}
+			}
+		}
+		params = append(params, param)
+	}
+	return params, nil
+}
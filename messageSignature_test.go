@@ -0,0 +1,276 @@
+package transport_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-chi/transport"
+)
+
+// Examples from RFC 9421 appendix B.2.
+func TestVerifyRequestSignatureRFC9421(t *testing.T) {
+	der, _ := base64.StdEncoding.DecodeString("MCowBQYDK2VwAyEAJrQLj5P/89iXES9+vFgrIy29clF9CC/oPPsw3c5D0bs=")
+	publicKey, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ed25519Key, err := transport.NewSignatureKey("test-key-ed25519", publicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	secret, _ := base64.StdEncoding.DecodeString("uzvJfB4u3N0Jy4T7NZ75MDVcr8zSTInedJtkgcu46YW4XByzNJjxBdtjUkdJPBtbmHhIDi6pcl8jsasjlTMtDQ==")
+	hmacKey, err := transport.NewSignatureKey("test-shared-secret", secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tt := []struct {
+		name           string
+		key            transport.SignatureKey
+		signatureInput string
+		signature      string
+	}{
+		{
+			name:           "B.2.5 HMAC-SHA256",
+			key:            hmacKey,
+			signatureInput: `sig-b25=("date" "@authority" "content-type");created=1618884473;keyid="test-shared-secret"`,
+			signature:      `sig-b25=:pxcQw6G3AjtMBQjwo8XzkZf/bws5LelbaMk5rGIGtE8=:`,
+		},
+		{
+			name:           "B.2.5 with non-canonical whitespace",
+			key:            hmacKey,
+			signatureInput: `sig-b25=( "date"  "@authority" "content-type" );created=1618884473; keyid="test-shared-secret"`,
+			signature:      `sig-b25=:pxcQw6G3AjtMBQjwo8XzkZf/bws5LelbaMk5rGIGtE8=:`,
+		},
+		{
+			name:           "B.2.6 Ed25519",
+			key:            ed25519Key,
+			signatureInput: `sig-b26=("date" "@method" "@path" "@authority" "content-type" "content-length");created=1618884473;keyid="test-key-ed25519"`,
+			signature:      `sig-b26=:wqcAqbmYJ2ji2glfAMaRy4gruYYnx2nEFN2HN6jrnDnQCK1u02Gb04v9EDgwUPiu4A0w6vuQv5lIp5WPpBKRCw==:`,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			req, err := http.NewRequest("POST", "http://example.com/foo?param=Value&Pet=dog", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Date", "Tue, 20 Apr 2021 02:07:55 GMT")
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("Content-Length", "18")
+			req.Header.Set("Signature-Input", tc.signatureInput)
+			req.Header.Set("Signature", tc.signature)
+
+			if err := transport.VerifyRequestSignature(req, transport.MessageVerifyOptions{Key: tc.key}); err != nil {
+				t.Fatal(err)
+			}
+
+			req.Header.Set("Content-Type", "text/plain")
+			if err := transport.VerifyRequestSignature(req, transport.MessageVerifyOptions{Key: tc.key}); !errors.Is(err, transport.ErrInvalidSignature) {
+				t.Fatalf("expected ErrInvalidSignature for modified request, got %v", err)
+			}
+		})
+	}
+}
+
+func TestMessageSignatures(t *testing.T) {
+	_, ed25519PrivateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecdsaPrivateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys := map[string]struct {
+		private interface{}
+		public  interface{}
+	}{
+		"ed25519":           {ed25519PrivateKey, ed25519PrivateKey.Public()},
+		"ecdsa-p256-sha256": {ecdsaPrivateKey, &ecdsaPrivateKey.PublicKey},
+		"hmac-sha256":       {[]byte("secret"), []byte("secret")},
+	}
+
+	for alg, k := range keys {
+		t.Run(alg, func(t *testing.T) {
+			signingKey, err := transport.NewSignatureKey("client", k.private)
+			if err != nil {
+				t.Fatal(err)
+			}
+			verifyingKey, err := transport.NewSignatureKey("client", k.public)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if signingKey.Algorithm() != alg {
+				t.Fatalf("expected %v key, got %v", alg, signingKey.Algorithm())
+			}
+
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				err := transport.VerifyRequestSignature(r, transport.MessageVerifyOptions{
+					Key:                verifyingKey,
+					RequiredComponents: []string{"@method", "@target-uri", "@authority", "content-type"},
+				})
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusUnauthorized)
+					return
+				}
+				w.Header().Set("Content-Type", "text/plain")
+				w.Write([]byte("ok"))
+			}))
+			defer server.Close()
+
+			// The server responses are signed by the base transport,
+			// covering the request method and target with the req parameter.
+			signResponses := transport.RoundTripFunc(func(req *http.Request) (*http.Response, error) {
+				resp, err := http.DefaultTransport.RoundTrip(req)
+				if err != nil {
+					return nil, err
+				}
+				err = transport.SignResponse(resp, transport.MessageSignatureOptions{
+					Key:        signingKey,
+					Components: []string{"@status", "content-type", "@method;req", "@target-uri;req"},
+				})
+				return resp, err
+			})
+
+			client := &http.Client{
+				Transport: transport.Chain(
+					signResponses,
+					transport.VerifyResponses(transport.MessageVerifyOptions{
+						Key:                verifyingKey,
+						RequiredComponents: []string{"@status", "@target-uri;req"},
+					}),
+					transport.SignRequests(transport.MessageSignatureOptions{
+						Key:        signingKey,
+						Components: []string{"@method", "@target-uri", "@authority", "content-type"},
+					}),
+				),
+			}
+
+			req, err := http.NewRequest("PUT", server.URL+"/items/1?force=true", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Content-Type", "application/json")
+
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+
+			if resp.StatusCode != 200 {
+				t.Fatalf("expected valid request signature, got HTTP %v", resp.StatusCode)
+			}
+			if resp.Header.Get("Signature-Input") == "" || resp.Header.Get("Signature") == "" {
+				t.Fatal("expected signed response")
+			}
+		})
+	}
+}
+
+const expiredSignatureBase = `"@status": 200
+"@signature-params": ("@status");created=1618884473;expires=1618884533;keyid="server";alg="hmac-sha256"`
+
+func hmacSHA256(secret string, message string) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(message))
+	return mac.Sum(nil)
+}
+
+func TestVerifyResponses(t *testing.T) {
+	key, err := transport.NewSignatureKey("server", []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := transport.NewSignatureKey("server", []byte("other secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tt := []struct {
+		name   string
+		sign   *transport.MessageSignatureOptions
+		header map[string]string
+		opts   transport.MessageVerifyOptions
+	}{
+		{
+			name: "valid",
+			sign: &transport.MessageSignatureOptions{Key: key},
+			opts: transport.MessageVerifyOptions{Key: key},
+		},
+		{
+			name: "unsigned",
+			opts: transport.MessageVerifyOptions{Key: key},
+		},
+		{
+			name: "wrong key",
+			sign: &transport.MessageSignatureOptions{Key: otherKey},
+			opts: transport.MessageVerifyOptions{Key: key},
+		},
+		{
+			name: "required component not covered",
+			sign: &transport.MessageSignatureOptions{Key: key},
+			opts: transport.MessageVerifyOptions{Key: key, RequiredComponents: []string{"content-type"}},
+		},
+		{
+			name: "expired",
+			header: map[string]string{
+				"Signature-Input": `sig=("@status");created=1618884473;expires=1618884533;keyid="server";alg="hmac-sha256"`,
+				"Signature":       "sig=:" + base64.StdEncoding.EncodeToString(hmacSHA256("secret", expiredSignatureBase)) + ":",
+			},
+			opts: transport.MessageVerifyOptions{Key: key},
+		},
+		{
+			name: "no key",
+			sign: &transport.MessageSignatureOptions{Key: key},
+			opts: transport.MessageVerifyOptions{},
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			client := &http.Client{
+				Transport: transport.Chain(
+					transport.RoundTripFunc(func(req *http.Request) (*http.Response, error) {
+						resp := &http.Response{StatusCode: 200, Header: http.Header{}, Body: http.NoBody, Request: req}
+						for k, v := range tc.header {
+							resp.Header.Set(k, v)
+						}
+						if tc.sign != nil {
+							if err := transport.SignResponse(resp, *tc.sign); err != nil {
+								return nil, err
+							}
+						}
+						return resp, nil
+					}),
+					transport.VerifyResponses(tc.opts),
+				),
+			}
+
+			_, err := client.Get("http://example.com")
+			if tc.name == "valid" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if !errors.Is(err, transport.ErrInvalidSignature) {
+				t.Fatalf("expected ErrInvalidSignature, got %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,104 @@
+package transport
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// OAuth2ClientCredentials is a middleware authenticating requests with
+// an access token obtained via the OAuth2 client credentials grant
+// (RFC 6749 section 4.4). The token is cached and refreshed shortly before
+// it expires, concurrent requests share a single token fetch. See
+// BearerToken for details.
+//
+//	client := &http.Client{
+//	    Transport: transport.Chain(
+//	        http.DefaultTransport,
+//	        transport.OAuth2ClientCredentials(tokenURL, clientID, clientSecret, []string{"read"}),
+//	    ),
+//	}
+//
+// The token is fetched through the rest of the chain.
+func OAuth2ClientCredentials(tokenURL, clientID, clientSecret string, scopes []string) func(http.RoundTripper) http.RoundTripper {
+	c := &clientCredentials{
+		tokenURL:     tokenURL,
+		clientID:     clientID,
+		clientSecret: clientSecret,
+		scopes:       scopes,
+	}
+
+	return bearerToken(c.fetch)
+}
+
+type clientCredentials struct {
+	tokenURL     string
+	clientID     string
+	clientSecret string
+	scopes       []string
+}
+
+// fetch requests a new access token from the token endpoint.
+func (c *clientCredentials) fetch(ctx context.Context, next http.RoundTripper) (string, time.Time, error) {
+	form := url.Values{"grant_type": {"client_credentials"}}
+	if len(c.scopes) > 0 {
+		form.Set("scope", strings.Join(c.scopes, " "))
+	}
+
+	req, err := http.NewRequest("POST", c.tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(c.clientID), url.QueryEscape(c.clientSecret))
+
+	requestTime := time.Now()
+	resp, err := next.RoundTrip(req)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	var token struct {
+		AccessToken      string `json:"access_token"`
+		TokenType        string `json:"token_type"`
+		ExpiresIn        int64  `json:"expires_in"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.Unmarshal(body, &token); err != nil && resp.StatusCode < 300 {
+		return "", time.Time{}, fmt.Errorf("decoding token response: %w", err)
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		if token.Error != "" {
+			return "", time.Time{}, fmt.Errorf("token endpoint: HTTP %v: %v: %v", resp.StatusCode, token.Error, token.ErrorDescription)
+		}
+		return "", time.Time{}, fmt.Errorf("token endpoint: HTTP %v", resp.StatusCode)
+	}
+	if token.AccessToken == "" {
+		return "", time.Time{}, fmt.Errorf("token endpoint: no access_token in response")
+	}
+	if token.TokenType != "" && !strings.EqualFold(token.TokenType, "Bearer") {
+		return "", time.Time{}, fmt.Errorf("token endpoint: unsupported token_type %q", token.TokenType)
+	}
+
+	var expiry time.Time
+	if token.ExpiresIn > 0 {
+		expiry = requestTime.Add(time.Duration(token.ExpiresIn) * time.Second)
+	}
+	return token.AccessToken, expiry, nil
+}
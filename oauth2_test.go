@@ -0,0 +1,87 @@
+package transport_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/go-chi/transport"
+	"golang.org/x/sync/errgroup"
+)
+
+func TestOAuth2ClientCredentials(t *testing.T) {
+	var tokensIssued int32
+	tokenServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		clientID, secret, _ := r.BasicAuth()
+		if clientID != "client" || secret != "s3cr3t" {
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprintf(w, `{"error":"invalid_client"}`)
+			return
+		}
+		if r.FormValue("grant_type") != "client_credentials" || r.FormValue("scope") != "read write" {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, `{"error":"invalid_request"}`)
+			return
+		}
+
+		n := atomic.AddInt32(&tokensIssued, 1)
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"access_token":"token-%v","token_type":"Bearer","expires_in":3600}`, n)
+	}))
+	defer tokenServer.Close()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token-1" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprintf(w, "ok")
+	}))
+	defer server.Close()
+
+	client := &http.Client{
+		Transport: transport.Chain(
+			http.DefaultTransport,
+			transport.OAuth2ClientCredentials(tokenServer.URL, "client", "s3cr3t", []string{"read", "write"}),
+		),
+	}
+
+	var g errgroup.Group
+	for i := 0; i < 20; i++ {
+		g.Go(func() error {
+			resp, err := client.Get(server.URL)
+			if err != nil {
+				return err
+			}
+			resp.Body.Close()
+
+			if resp.StatusCode != 200 {
+				return fmt.Errorf("expected HTTP 200, got %v", resp.StatusCode)
+			}
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := atomic.LoadInt32(&tokensIssued); got != 1 {
+		t.Fatalf("expected 1 token to be issued, got %v", got)
+	}
+
+	t.Run("invalid client", func(t *testing.T) {
+		client := &http.Client{
+			Transport: transport.Chain(
+				http.DefaultTransport,
+				transport.OAuth2ClientCredentials(tokenServer.URL, "client", "wrong", []string{"read", "write"}),
+			),
+		}
+
+		_, err := client.Get(server.URL)
+		if err == nil {
+			t.Fatal("expected error")
+		}
+	})
+}
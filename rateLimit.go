@@ -0,0 +1,173 @@
+package transport
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// RateLimitOptions configures the RateLimit middleware.
+type RateLimitOptions struct {
+	// RequestsPerSecond is the sustained rate of requests allowed per key.
+	RequestsPerSecond float64
+
+	// Burst is the number of requests that can be sent at once, on top of
+	// the sustained rate. Defaults to 1.
+	Burst int
+
+	// Key returns the rate limit bucket a request belongs to, e.g. the API
+	// key it's sent with. Defaults to req.URL.Host.
+	Key func(req *http.Request) string
+
+	// Adaptive makes the limiter follow the quota advertised by upstream
+	// via RateLimit-Remaining and RateLimit-Reset response headers (or their
+	// X-RateLimit-* variants), holding requests back once the quota is used up.
+	Adaptive bool
+}
+
+// RateLimit is a middleware that limits the rate of requests per destination
+// host (or per custom key), using token buckets. Requests over the limit are
+// held back until a token is available or the request context is done.
+//
+//	client := &http.Client{
+//	    Transport: transport.Chain(
+//	        http.DefaultTransport,
+//	        transport.RateLimit(transport.RateLimitOptions{
+//	            RequestsPerSecond: 10,
+//	            Burst:             20,
+//	            Adaptive:          true,
+//	        }),
+//	    ),
+//	}
+func RateLimit(opts RateLimitOptions) func(http.RoundTripper) http.RoundTripper {
+	if opts.RequestsPerSecond <= 0 {
+		panic("transport: RateLimit: RequestsPerSecond must be positive")
+	}
+	if opts.Burst <= 0 {
+		opts.Burst = 1
+	}
+	if opts.Key == nil {
+		opts.Key = func(req *http.Request) string { return req.URL.Host }
+	}
+
+	var mu sync.Mutex
+	buckets := map[string]*tokenBucket{}
+
+	bucket := func(key string) *tokenBucket {
+		mu.Lock()
+		defer mu.Unlock()
+
+		b, ok := buckets[key]
+		if !ok {
+			b = newTokenBucket(opts.RequestsPerSecond, opts.Burst)
+			buckets[key] = b
+		}
+		return b
+	}
+
+	return func(next http.RoundTripper) http.RoundTripper {
+		return RoundTripFunc(func(req *http.Request) (*http.Response, error) {
+			ctx := req.Context()
+			b := bucket(opts.Key(req))
+
+			if wait := b.reserve(time.Now()); wait > 0 {
+				timer := time.NewTimer(wait)
+				select {
+				case <-ctx.Done():
+					timer.Stop()
+					b.cancel()
+					return nil, ctx.Err()
+				case <-timer.C:
+				}
+			}
+
+			resp, err := next.RoundTrip(req)
+			if opts.Adaptive && resp != nil {
+				b.adapt(resp.Header, time.Now())
+			}
+
+			return resp, err
+		})
+	}
+}
+
+// tokenBucket is a token bucket rate limiter. Tokens can go negative,
+// representing requests waiting for their turn.
+type tokenBucket struct {
+	mu           sync.Mutex
+	rate         float64 // tokens per second
+	burst        float64
+	tokens       float64
+	last         time.Time
+	blockedUntil time.Time
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	return &tokenBucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	if now.Before(b.blockedUntil) {
+		b.last = now
+		return
+	}
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens += elapsed.Seconds() * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+		b.last = now
+	}
+}
+
+// reserve takes a token and returns how long to wait before using it.
+func (b *tokenBucket) reserve(now time.Time) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refill(now)
+	b.tokens--
+
+	var wait time.Duration
+	if b.tokens < 0 {
+		wait = time.Duration(-b.tokens / b.rate * float64(time.Second))
+	}
+	if blocked := b.blockedUntil.Sub(now); blocked > 0 {
+		wait += blocked
+	}
+	return wait
+}
+
+// cancel returns a reserved token that won't be used.
+func (b *tokenBucket) cancel() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.tokens++
+}
+
+// adapt limits the bucket to the quota advertised by the upstream.
+func (b *tokenBucket) adapt(h http.Header, now time.Time) {
+	remaining, ok := rateLimitRemaining(h)
+	if !ok {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refill(now)
+	if float64(remaining) < b.tokens {
+		b.tokens = float64(remaining)
+	}
+	if remaining == 0 {
+		if reset, ok := rateLimitReset(h, now); ok {
+			b.blockedUntil = now.Add(reset)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package transport_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-chi/transport"
+)
+
+func TestRateLimit(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "ok")
+	}))
+	defer server.Close()
+
+	client := &http.Client{
+		Transport: transport.Chain(
+			http.DefaultTransport,
+			transport.RateLimit(transport.RateLimitOptions{
+				RequestsPerSecond: 20,
+				Burst:             2,
+			}),
+		),
+	}
+
+	timeStart := time.Now()
+	for i := 0; i < 6; i++ {
+		resp, err := client.Get(server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+
+	// 2 requests burst, the other 4 at 50ms intervals.
+	if elapsed := time.Since(timeStart); elapsed < 200*time.Millisecond {
+		t.Fatalf("expected at least 200ms, but took %v", elapsed)
+	}
+}
+
+func TestRateLimitAdaptive(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("RateLimit-Remaining", "0")
+		w.Header().Set("RateLimit-Reset", "1")
+		fmt.Fprintf(w, "ok")
+	}))
+	defer server.Close()
+
+	client := &http.Client{
+		Transport: transport.Chain(
+			http.DefaultTransport,
+			transport.RateLimit(transport.RateLimitOptions{
+				RequestsPerSecond: 1000,
+				Burst:             100,
+				Adaptive:          true,
+			}),
+		),
+	}
+
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	// The quota is used up for the next second.
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	req, err := http.NewRequest("GET", server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = client.Do(req.WithContext(ctx))
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected request to be held back until the deadline, got %v", err)
+	}
+}
@@ -1,72 +1,353 @@
 package transport
 
 import (
+	"context"
+	"crypto/rand"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
 	"net/http"
-	"log"
-	"time"
 	"strconv"
-	"math"
+	"strings"
+	"syscall"
+	"time"
 )
 
+// RetryPolicy configures how and when RetryWithPolicy retries requests.
+// Zero values fall back to the defaults of DefaultRetryPolicy.
+type RetryPolicy struct {
+	// MaxRetries is the maximum number of retries after the initial attempt.
+	MaxRetries int
+
+	// MinBackoff is the wait before the first retry, MaxBackoff caps the wait
+	// between any two attempts.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+
+	// Multiplier grows the backoff exponentially with each attempt.
+	Multiplier float64
+
+	// Jitter randomizes the computed backoff, e.g. FullJitter or EqualJitter.
+	// Defaults to NoJitter.
+	Jitter func(backoff time.Duration) time.Duration
+
+	// RetryableStatus reports whether a response should be retried.
+	// Defaults to IsRetryableStatus.
+	RetryableStatus func(resp *http.Response) bool
+
+	// RetryableError classifies transport errors, reporting whether
+	// the request should be retried. Defaults to IsRetryableError.
+	RetryableError func(err error) bool
+
+	// MaxElapsedTime stops retrying once the time spent on a request,
+	// including the upcoming wait, would exceed it. Zero means no limit.
+	MaxElapsedTime time.Duration
+
+	// MaxBufferedBody caps how many bytes of a request body are kept in
+	// memory, so the body can be sent again on retries. Bodies with GetBody
+	// set are rewound instead. Requests with larger bodies are not retried.
+	// Defaults to 1 MiB.
+	MaxBufferedBody int64
+
+	// RetryNonIdempotent allows retrying requests of any method. By default,
+	// only idempotent methods (GET, HEAD, OPTIONS, TRACE, PUT, DELETE) and
+	// requests carrying an Idempotency-Key header are retried.
+	RetryNonIdempotent bool
+
+	// IdempotencyKey, if set, generates an Idempotency-Key header for
+	// non-idempotent requests that don't have one yet, which makes them
+	// retryable. The same key is sent with every attempt of the request.
+	// See NewIdempotencyKey.
+	IdempotencyKey func(req *http.Request) string
+
+	// MaxRetryAfter is the longest wait requested by the server via
+	// Retry-After or rate limit headers that is honored. If the server asks
+	// for a longer wait, or a wait past the request context deadline,
+	// the request fails fast with *RetryAfterError. Defaults to 1 minute.
+	MaxRetryAfter time.Duration
+
+	// Budget, if set, limits the ratio of retries to requests across all
+	// requests sharing the budget. Retries over the budget are not made.
+	Budget *RetryBudget
+
+	// OnRetry, if set, is called before waiting for each retry with the
+	// failed response or error, e.g. to log the retries (see LogRetry)
+	// or to collect metrics. The attempt is 1 for the first retry.
+	OnRetry func(ctx context.Context, attempt int, req *http.Request, resp *http.Response, err error, wait time.Duration)
+}
+
+// DefaultRetryPolicy returns the default policy: exponential backoff
+// between 2s and 16s, retrying 429 and 5xx responses and network errors,
+// honoring server-requested waits of up to 1 minute.
+func DefaultRetryPolicy(maxRetries int) RetryPolicy {
+	return RetryPolicy{
+		MaxRetries:      maxRetries,
+		MinBackoff:      2 * time.Second,
+		MaxBackoff:      16 * time.Second,
+		Multiplier:      2,
+		Jitter:          NoJitter,
+		RetryableStatus: IsRetryableStatus,
+		RetryableError:  IsRetryableError,
+		MaxBufferedBody: 1 << 20,
+		MaxRetryAfter:   time.Minute,
+	}
+}
+
+func (p RetryPolicy) withDefaults() RetryPolicy {
+	defaults := DefaultRetryPolicy(p.MaxRetries)
+	if p.MinBackoff <= 0 {
+		p.MinBackoff = defaults.MinBackoff
+	}
+	if p.MaxBackoff <= 0 {
+		p.MaxBackoff = defaults.MaxBackoff
+	}
+	if p.MaxBackoff < p.MinBackoff {
+		p.MaxBackoff = p.MinBackoff
+	}
+	if p.Multiplier < 1 {
+		p.Multiplier = defaults.Multiplier
+	}
+	if p.Jitter == nil {
+		p.Jitter = defaults.Jitter
+	}
+	if p.RetryableStatus == nil {
+		p.RetryableStatus = defaults.RetryableStatus
+	}
+	if p.RetryableError == nil {
+		p.RetryableError = defaults.RetryableError
+	}
+	if p.MaxBufferedBody <= 0 {
+		p.MaxBufferedBody = defaults.MaxBufferedBody
+	}
+	if p.MaxRetryAfter <= 0 {
+		p.MaxRetryAfter = defaults.MaxRetryAfter
+	}
+	return p
+}
+
+// RetryWithPolicy is a middleware that retries failed requests according
+// to the given policy. Each attempt is sent through the rest of the chain,
+// so retries are logged, signed and authenticated just like the original
+// request:
+//
+//	client := &http.Client{
+//	    Transport: transport.Chain(
+//	        http.DefaultTransport,
+//	        transport.RetryWithPolicy(transport.RetryPolicy{
+//	            MaxRetries: 3,
+//	            MinBackoff: 100 * time.Millisecond,
+//	            MaxBackoff: 2 * time.Second,
+//	            Jitter:     transport.FullJitter,
+//	        }),
+//	        transport.SetHeader("Authorization", authHeader),
+//	        transport.LogRequests(transport.LogOptions{Concise: true}),
+//	    ),
+//	}
+func RetryWithPolicy(policy RetryPolicy) func(http.RoundTripper) http.RoundTripper {
+	return retryRequests(nil, policy)
+}
+
+// Retry is a middleware that retries idempotent requests failing with 429 or 5xx
+// responses or network errors against baseTransport, up to maxRetries times.
+//
+// Deprecated: Retries bypass the middlewares following Retry in the chain.
+// Use RetryWithPolicy(DefaultRetryPolicy(maxRetries)) instead.
 func Retry(baseTransport http.RoundTripper, maxRetries int) func(http.RoundTripper) http.RoundTripper {
+	return retryRequests(baseTransport, DefaultRetryPolicy(maxRetries))
+}
+
+// retryRequests sends the retries to baseTransport, or through the rest
+// of the chain if baseTransport is nil.
+func retryRequests(baseTransport http.RoundTripper, policy RetryPolicy) func(http.RoundTripper) http.RoundTripper {
+	policy = policy.withDefaults()
+
 	return func(next http.RoundTripper) http.RoundTripper {
-		return RoundTripFunc(func(req *http.Request) (resp *http.Response, err error) {
-			defer func() {
-				if isRetryable(resp) {
-					for i := 1; i <= maxRetries; i++ {
-						wait := backOff(resp, i)
-
-						timer := time.NewTimer(wait)
-
-						log.Printf("waiting %s", wait.String())
-
-						select {
-						case <-req.Context().Done():
-							log.Printf("request was cancelled")
-							timer.Stop()
-							break
-						case <-timer.C:
-						}
-
-						startTime := time.Now()
-						resp, err = baseTransport.RoundTrip(req)
-						if !isRetryable(resp) {
-							break
-						}
-
-						log.Printf("retrying %d request: %s %s", i, req.Method, req.URL)
-						log.Printf("response (%v): %v %s", time.Since(startTime), resp.Status, resp.Request.URL)
-					}
+		rt := baseTransport
+		if rt == nil {
+			rt = next
+		}
+
+		return RoundTripFunc(func(req *http.Request) (*http.Response, error) {
+			ctx := req.Context()
+			firstAttempt := time.Now()
+
+			r := req
+			if policy.IdempotencyKey != nil && !isIdempotent(r) {
+				r = CloneRequest(req)
+				r.Header.Set("Idempotency-Key", policy.IdempotencyKey(r))
+			}
+
+			if policy.Budget != nil {
+				policy.Budget.deposit()
+			}
+
+			retryable := policy.MaxRetries > 0 && (policy.RetryNonIdempotent || isIdempotent(r))
+			if retryable {
+				var err error
+				r, err = bufferBody(r, policy.MaxBufferedBody)
+				if err != nil {
+					return nil, err
 				}
-			}()
+			}
+
+			resp, err := next.RoundTrip(r)
+
+			retries := 0
+			for retryable && retries < policy.MaxRetries && policy.shouldRetry(resp, err) {
+				attempt := retries + 1
 
-			return next.RoundTrip(req)
+				wait, serverHint := policy.backOff(resp, attempt)
+				if serverHint && !policy.canWait(ctx, wait) {
+					drainBody(resp)
+					return nil, &RetryAfterError{RetryAfter: wait, StatusCode: resp.StatusCode}
+				}
+				if policy.MaxElapsedTime > 0 && time.Since(firstAttempt)+wait > policy.MaxElapsedTime {
+					break
+				}
+				if policy.Budget != nil && !policy.Budget.withdraw() {
+					break
+				}
+
+				retry, rewindErr := rewindBody(r)
+				if rewindErr != nil {
+					drainBody(resp)
+					return nil, fmt.Errorf("retrying %s %s: %w", req.Method, req.URL, rewindErr)
+				}
+
+				if policy.OnRetry != nil {
+					policy.OnRetry(ctx, attempt, req, resp, err, wait)
+				}
+
+				// The response is superseded by the next attempt. Drain it,
+				// so its connection goes back to the pool.
+				drainBody(resp)
+
+				timer := time.NewTimer(wait)
+				select {
+				case <-ctx.Done():
+					timer.Stop()
+					return nil, ctx.Err()
+				case <-timer.C:
+				}
+
+				resp, err = rt.RoundTrip(retry)
+				retries++
+			}
+
+			return setRetryAttempts(resp, retries), err
 		})
 	}
 }
 
-func backOff(resp *http.Response, attempt int) time.Duration {
-	minDuration := 1 * time.Second
-	maxDuration := 16 * time.Second
+// RetryAttemptsHeader is the response header set by the retry middleware
+// to the number of retries it made before getting the response. It's only
+// set on responses to retried requests.
+const RetryAttemptsHeader = "X-Retry-Attempts"
 
-	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable {
-		if s, ok := resp.Header["Retry-After"]; ok {
-			if sleep, err := strconv.ParseInt(s[0], 10, 64); err == nil {
-				return time.Second * time.Duration(sleep)
-			}
+func setRetryAttempts(resp *http.Response, retries int) *http.Response {
+	if resp != nil && retries > 0 {
+		if resp.Header == nil {
+			resp.Header = http.Header{}
 		}
+		resp.Header.Set(RetryAttemptsHeader, strconv.Itoa(retries))
 	}
+	return resp
+}
 
-	// simple exp. backoff
-	mult := math.Pow(2, float64(attempt)) * float64(minDuration)
+// RetryAttempts returns the number of retries made by the retry middleware
+// before getting the given response.
+func RetryAttempts(resp *http.Response) int {
+	if resp == nil {
+		return 0
+	}
+	retries, _ := strconv.Atoi(resp.Header.Get(RetryAttemptsHeader))
+	return retries
+}
+
+// isIdempotent reports whether the request can be safely sent more than once,
+// following the same rules as net/http.
+func isIdempotent(req *http.Request) bool {
+	switch req.Method {
+	case "", "GET", "HEAD", "OPTIONS", "TRACE", "PUT", "DELETE":
+		return true
+	}
+	if _, ok := req.Header["Idempotency-Key"]; ok {
+		return true
+	}
+	if _, ok := req.Header["X-Idempotency-Key"]; ok {
+		return true
+	}
+	return false
+}
+
+// NewIdempotencyKey generates a random UUID (version 4) to be used
+// as Idempotency-Key header value. See RetryPolicy.IdempotencyKey.
+func NewIdempotencyKey(req *http.Request) string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(fmt.Sprintf("reading random bytes: %v", err))
+	}
+	b[6] = (b[6] & 0x0f) | 0x40 // version 4
+	b[8] = (b[8] & 0x3f) | 0x80 // variant 10
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
+func (p RetryPolicy) shouldRetry(resp *http.Response, err error) bool {
+	if err != nil {
+		return p.RetryableError(err)
+	}
+	return p.RetryableStatus(resp)
+}
+
+// backOff returns the wait before the given attempt and whether the wait
+// was requested by the server.
+func (p RetryPolicy) backOff(resp *http.Response, attempt int) (time.Duration, bool) {
+	if wait, ok := retryAfter(resp, time.Now()); ok {
+		return wait, true
+	}
+
+	// exp. backoff, starting at MinBackoff
+	mult := math.Pow(p.Multiplier, float64(attempt-1)) * float64(p.MinBackoff)
 	sleep := time.Duration(mult)
-	if float64(sleep) != mult || sleep > maxDuration {
-		sleep = maxDuration
+	if float64(sleep) != mult || sleep > p.MaxBackoff {
+		sleep = p.MaxBackoff
 	}
-	return sleep
+	return p.Jitter(sleep), false
+}
+
+// canWait reports whether a wait requested by the server is acceptable.
+func (p RetryPolicy) canWait(ctx context.Context, wait time.Duration) bool {
+	if wait > p.MaxRetryAfter {
+		return false
+	}
+	if deadline, ok := ctx.Deadline(); ok && time.Now().Add(wait).After(deadline) {
+		return false
+	}
+	return true
+}
+
+// NoJitter returns the backoff unchanged.
+func NoJitter(backoff time.Duration) time.Duration {
+	return backoff
+}
+
+// FullJitter returns a random duration between zero and the backoff.
+func FullJitter(backoff time.Duration) time.Duration {
+	return randDelay(0, backoff)
 }
 
-func isRetryable(resp *http.Response) bool {
+// EqualJitter returns a random duration between half of the backoff
+// and the full backoff.
+func EqualJitter(backoff time.Duration) time.Duration {
+	return randDelay(backoff/2, backoff)
+}
+
+// IsRetryableStatus reports whether the response status is worth retrying,
+// i.e. 429 Too Many Requests or a 5xx other than 501 Not Implemented.
+func IsRetryableStatus(resp *http.Response) bool {
 	if resp == nil {
 		return false
 	}
@@ -85,3 +366,59 @@ func isRetryable(resp *http.Response) bool {
 
 	return false
 }
+
+// IsRetryableError reports whether a transport error is likely transient,
+// such as a refused or reset connection, a timeout, an unexpected EOF or
+// an HTTP/2 GOAWAY. Context cancellation and certificate errors are not
+// retryable.
+func IsRetryableError(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	// The caller gave up, retrying would not help.
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	// Certificate errors are permanent until somebody fixes the setup.
+	var unknownAuthorityErr x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var certInvalidErr x509.CertificateInvalidError
+	if errors.As(err, &unknownAuthorityErr) || errors.As(err, &hostnameErr) || errors.As(err, &certInvalidErr) {
+		return false
+	}
+
+	// The server closed the connection in the middle of a response,
+	// e.g. a keep-alive connection was closed while being reused.
+	if errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF) {
+		return true
+	}
+
+	if errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE) {
+		return true
+	}
+
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return !dnsErr.IsNotFound
+	}
+
+	// Dial, read and write errors, including TLS handshake timeouts.
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	var opErr *net.OpError
+	if errors.As(err, &opErr) {
+		return true
+	}
+
+	// The HTTP/2 errors are not exported by net/http.
+	msg := err.Error()
+	if strings.Contains(msg, "GOAWAY") || strings.Contains(msg, "http2: client connection lost") {
+		return true
+	}
+
+	return false
+}
@@ -0,0 +1,95 @@
+package transport
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RetryAfterError is returned by the retry middleware when the server asks
+// the client to wait longer than the retry policy or the request context
+// deadline allows.
+type RetryAfterError struct {
+	RetryAfter time.Duration
+	StatusCode int
+}
+
+func (e *RetryAfterError) Error() string {
+	return fmt.Sprintf("transport: HTTP %v: server asked to retry after %v", e.StatusCode, e.RetryAfter)
+}
+
+// retryAfter returns the wait requested by the server via the Retry-After
+// header (both delay-seconds and HTTP-date forms, see RFC 9110 section 10.2.3)
+// or, for 429 and 503 responses, via the RateLimit-Reset or X-RateLimit-Reset
+// headers.
+func retryAfter(resp *http.Response, now time.Time) (time.Duration, bool) {
+	if resp == nil {
+		return 0, false
+	}
+
+	if v := strings.TrimSpace(resp.Header.Get("Retry-After")); v != "" {
+		if seconds, err := strconv.ParseInt(v, 10, 64); err == nil && seconds >= 0 {
+			return time.Duration(seconds) * time.Second, true
+		}
+		if date, err := http.ParseTime(v); err == nil {
+			return nonNegative(date.Sub(now)), true
+		}
+	}
+
+	if resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode != http.StatusServiceUnavailable {
+		return 0, false
+	}
+
+	return rateLimitReset(resp.Header, now)
+}
+
+// rateLimitReset returns the time until the rate limit quota resets, as
+// advertised by the RateLimit-Reset or X-RateLimit-Reset response headers.
+func rateLimitReset(h http.Header, now time.Time) (time.Duration, bool) {
+	// RateLimit-Reset holds the number of seconds until the quota resets,
+	// see https://datatracker.ietf.org/doc/draft-ietf-httpapi-ratelimit-headers/.
+	if v := strings.TrimSpace(h.Get("RateLimit-Reset")); v != "" {
+		if seconds, err := strconv.ParseInt(v, 10, 64); err == nil && seconds >= 0 {
+			return time.Duration(seconds) * time.Second, true
+		}
+	}
+
+	// X-RateLimit-Reset is either seconds until the reset, or the reset time
+	// as Unix timestamp (e.g. GitHub API).
+	if v := strings.TrimSpace(h.Get("X-RateLimit-Reset")); v != "" {
+		if seconds, err := strconv.ParseInt(v, 10, 64); err == nil && seconds >= 0 {
+			if seconds > unixTimestampThreshold {
+				return nonNegative(time.Unix(seconds, 0).Sub(now)), true
+			}
+			return time.Duration(seconds) * time.Second, true
+		}
+	}
+
+	return 0, false
+}
+
+// rateLimitRemaining returns the remaining rate limit quota, as advertised
+// by the RateLimit-Remaining or X-RateLimit-Remaining response headers.
+func rateLimitRemaining(h http.Header) (int64, bool) {
+	for _, name := range []string{"RateLimit-Remaining", "X-RateLimit-Remaining"} {
+		if v := strings.TrimSpace(h.Get(name)); v != "" {
+			if remaining, err := strconv.ParseInt(v, 10, 64); err == nil && remaining >= 0 {
+				return remaining, true
+			}
+		}
+	}
+	return 0, false
+}
+
+// unixTimestampThreshold tells Unix timestamps (2001-09-09 onwards)
+// from delays in seconds.
+const unixTimestampThreshold = 1000000000
+
+func nonNegative(d time.Duration) time.Duration {
+	if d < 0 {
+		return 0
+	}
+	return d
+}
@@ -0,0 +1,59 @@
+package transport
+
+import (
+	"sync"
+	"time"
+)
+
+// RetryBudget limits the number of retries relative to the number of
+// requests, so retries can't multiply the load on an upstream that is
+// already struggling. Share one budget between all requests to the same
+// upstream by setting it on the RetryPolicy:
+//
+//	policy := transport.RetryPolicy{
+//	    MaxRetries: 3,
+//	    Budget:     transport.NewRetryBudget(0.1, 10), // at most 10% extra load
+//	}
+//
+// RetryBudget is safe for concurrent use.
+type RetryBudget struct {
+	ratio      float64
+	minRetries float64
+	mu         sync.Mutex
+	window     *slidingWindow
+}
+
+// NewRetryBudget creates a budget allowing retries for up to ratio of the
+// requests seen in the last 10 seconds (e.g. 0.1 for 10%), with a floor
+// of minRetriesPerSecond so low traffic clients can still retry.
+func NewRetryBudget(ratio float64, minRetriesPerSecond int) *RetryBudget {
+	windowSize := 10 * time.Second
+	return &RetryBudget{
+		ratio:      ratio,
+		minRetries: float64(minRetriesPerSecond) * windowSize.Seconds(),
+		window:     newSlidingWindow(windowSize, 10),
+	}
+}
+
+// deposit records an original (non-retry) request.
+func (b *RetryBudget) deposit() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.window.add(time.Now(), 1, 0)
+}
+
+// withdraw reports whether a retry is within the budget and, if so,
+// records it.
+func (b *RetryBudget) withdraw() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	requests, retries := b.window.sum(now)
+	if float64(retries+1) > b.ratio*float64(requests)+b.minRetries {
+		return false
+	}
+	b.window.add(now, 0, 1)
+	return true
+}
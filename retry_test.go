@@ -0,0 +1,647 @@
+package transport_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-chi/transport"
+)
+
+func TestRetryWithPolicy(t *testing.T) {
+	var hits int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		w.WriteHeader(http.StatusConflict)
+	}))
+	defer server.Close()
+
+	t.Run("custom retryable status", func(t *testing.T) {
+		atomic.StoreInt32(&hits, 0)
+
+		client := &http.Client{
+			Transport: transport.Chain(
+				http.DefaultTransport,
+				transport.RetryWithPolicy(transport.RetryPolicy{
+					MaxRetries: 3,
+					MinBackoff: time.Millisecond,
+					MaxBackoff: 5 * time.Millisecond,
+					Jitter:     transport.FullJitter,
+					RetryableStatus: func(resp *http.Response) bool {
+						return resp.StatusCode == http.StatusConflict
+					},
+				}),
+			),
+		}
+
+		resp, err := client.Get(server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		if got := atomic.LoadInt32(&hits); got != 4 {
+			t.Fatalf("expected 4 attempts, got %v", got)
+		}
+	})
+
+	t.Run("default status is not retried", func(t *testing.T) {
+		atomic.StoreInt32(&hits, 0)
+
+		client := &http.Client{
+			Transport: transport.Chain(
+				http.DefaultTransport,
+				transport.RetryWithPolicy(transport.RetryPolicy{
+					MaxRetries: 3,
+					MinBackoff: time.Millisecond,
+				}),
+			),
+		}
+
+		resp, err := client.Get(server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		if got := atomic.LoadInt32(&hits); got != 1 {
+			t.Fatalf("expected 1 attempt, got %v", got)
+		}
+	})
+
+	t.Run("max elapsed time", func(t *testing.T) {
+		atomic.StoreInt32(&hits, 0)
+
+		client := &http.Client{
+			Transport: transport.Chain(
+				http.DefaultTransport,
+				transport.RetryWithPolicy(transport.RetryPolicy{
+					MaxRetries:     10,
+					MinBackoff:     20 * time.Millisecond,
+					Multiplier:     1,
+					MaxElapsedTime: 50 * time.Millisecond,
+					RetryableStatus: func(resp *http.Response) bool {
+						return true
+					},
+				}),
+			),
+		}
+
+		resp, err := client.Get(server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		if got := atomic.LoadInt32(&hits); got > 3 {
+			t.Fatalf("expected at most 3 attempts within 50ms, got %v", got)
+		}
+	})
+}
+
+func TestRetryOnNetworkError(t *testing.T) {
+	var hits int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&hits, 1) < 3 {
+			// Drop the connection without sending any response.
+			conn, _, err := w.(http.Hijacker).Hijack()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			conn.Close()
+			return
+		}
+
+		fmt.Fprintf(w, "ok")
+	}))
+	defer server.Close()
+
+	client := &http.Client{
+		Transport: transport.Chain(
+			http.DefaultTransport,
+			transport.RetryWithPolicy(transport.RetryPolicy{
+				MaxRetries: 3,
+				MinBackoff: time.Millisecond,
+			}),
+		),
+	}
+
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		t.Fatalf("expected HTTP 200, got %v", resp.StatusCode)
+	}
+	if got := atomic.LoadInt32(&hits); got != 3 {
+		t.Fatalf("expected 3 attempts, got %v", got)
+	}
+}
+
+func TestIsRetryableError(t *testing.T) {
+	tt := []struct {
+		err       error
+		retryable bool
+	}{
+		{nil, false},
+		{io.ErrUnexpectedEOF, true},
+		{fmt.Errorf("reading response: %w", io.EOF), true},
+		{&net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}, true},
+		{&net.DNSError{Err: "no such host", Name: "example.invalid", IsNotFound: true}, false},
+		{&net.DNSError{Err: "server misbehaving", Name: "example.com", IsTemporary: true}, true},
+		{errors.New("http2: server sent GOAWAY and closed the connection"), true},
+		{context.Canceled, false},
+		{fmt.Errorf("dial: %w", context.DeadlineExceeded), false},
+		{errors.New("unsupported protocol scheme"), false},
+	}
+
+	for _, tc := range tt {
+		if got := transport.IsRetryableError(tc.err); got != tc.retryable {
+			t.Errorf("IsRetryableError(%v) = %v, expected %v", tc.err, got, tc.retryable)
+		}
+	}
+}
+
+func TestRetryReplaysBody(t *testing.T) {
+	payload := strings.Repeat("payload", 100)
+
+	var hits int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+		}
+		if string(b) != payload {
+			t.Errorf("unexpected body (%v bytes)", len(b))
+		}
+
+		if atomic.AddInt32(&hits, 1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintf(w, "ok")
+	}))
+	defer server.Close()
+
+	t.Run("buffered body", func(t *testing.T) {
+		atomic.StoreInt32(&hits, 0)
+
+		client := &http.Client{
+			Transport: transport.Chain(
+				http.DefaultTransport,
+				transport.RetryWithPolicy(transport.RetryPolicy{
+					MaxRetries: 3,
+					MinBackoff: time.Millisecond,
+				}),
+			),
+		}
+
+		// io.MultiReader hides the body type, so the request has no GetBody.
+		req, err := http.NewRequest("PUT", server.URL, io.MultiReader(strings.NewReader(payload)))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != 200 {
+			t.Fatalf("expected HTTP 200, got %v", resp.StatusCode)
+		}
+	})
+
+	t.Run("body too large to replay", func(t *testing.T) {
+		atomic.StoreInt32(&hits, 0)
+
+		client := &http.Client{
+			Transport: transport.Chain(
+				http.DefaultTransport,
+				transport.RetryWithPolicy(transport.RetryPolicy{
+					MaxRetries:      3,
+					MinBackoff:      time.Millisecond,
+					MaxBufferedBody: 10,
+				}),
+			),
+		}
+
+		req, err := http.NewRequest("PUT", server.URL, io.MultiReader(strings.NewReader(payload)))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = client.Do(req)
+		if !errors.Is(err, transport.ErrBodyNotReplayable) {
+			t.Fatalf("expected ErrBodyNotReplayable, got %v", err)
+		}
+		if got := atomic.LoadInt32(&hits); got != 1 {
+			t.Fatalf("expected 1 attempt, got %v", got)
+		}
+	})
+}
+
+func TestRetryIdempotency(t *testing.T) {
+	var hits int32
+	var keys sync.Map
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		keys.Store(r.Header.Get("Idempotency-Key"), true)
+
+		if atomic.AddInt32(&hits, 1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintf(w, "ok")
+	}))
+	defer server.Close()
+
+	t.Run("POST is not retried by default", func(t *testing.T) {
+		atomic.StoreInt32(&hits, 0)
+
+		client := &http.Client{
+			Transport: transport.Chain(
+				http.DefaultTransport,
+				transport.RetryWithPolicy(transport.RetryPolicy{
+					MaxRetries: 3,
+					MinBackoff: time.Millisecond,
+				}),
+			),
+		}
+
+		resp, err := client.Post(server.URL, "text/plain", strings.NewReader("charge"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusServiceUnavailable {
+			t.Fatalf("expected HTTP 503, got %v", resp.StatusCode)
+		}
+		if got := atomic.LoadInt32(&hits); got != 1 {
+			t.Fatalf("expected 1 attempt, got %v", got)
+		}
+	})
+
+	t.Run("POST with idempotency key", func(t *testing.T) {
+		atomic.StoreInt32(&hits, 0)
+		keys = sync.Map{}
+
+		client := &http.Client{
+			Transport: transport.Chain(
+				http.DefaultTransport,
+				transport.RetryWithPolicy(transport.RetryPolicy{
+					MaxRetries:     3,
+					MinBackoff:     time.Millisecond,
+					IdempotencyKey: transport.NewIdempotencyKey,
+				}),
+			),
+		}
+
+		resp, err := client.Post(server.URL, "text/plain", strings.NewReader("charge"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != 200 {
+			t.Fatalf("expected HTTP 200, got %v", resp.StatusCode)
+		}
+		if got := atomic.LoadInt32(&hits); got != 3 {
+			t.Fatalf("expected 3 attempts, got %v", got)
+		}
+
+		var n int
+		keys.Range(func(key, _ interface{}) bool {
+			if key == "" {
+				t.Error("expected Idempotency-Key header")
+			}
+			n++
+			return true
+		})
+		if n != 1 {
+			t.Fatalf("expected the same Idempotency-Key on all attempts, got %v different keys", n)
+		}
+	})
+}
+
+func TestRetryAfter(t *testing.T) {
+	var hits int32
+	var retryAfterHeader, retryAfterValue string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&hits, 1) < 2 {
+			w.Header().Set(retryAfterHeader, retryAfterValue)
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		fmt.Fprintf(w, "ok")
+	}))
+	defer server.Close()
+
+	client := &http.Client{
+		Transport: transport.Chain(
+			http.DefaultTransport,
+			transport.RetryWithPolicy(transport.RetryPolicy{
+				MaxRetries:    3,
+				MinBackoff:    time.Millisecond,
+				MaxRetryAfter: 10 * time.Second,
+			}),
+		),
+	}
+
+	t.Run("HTTP-date", func(t *testing.T) {
+		atomic.StoreInt32(&hits, 0)
+		retryAfterHeader = "Retry-After"
+		retryAfterValue = time.Now().Add(-time.Second).UTC().Format(http.TimeFormat)
+
+		resp, err := client.Get(server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != 200 {
+			t.Fatalf("expected HTTP 200, got %v", resp.StatusCode)
+		}
+	})
+
+	t.Run("X-RateLimit-Reset timestamp", func(t *testing.T) {
+		atomic.StoreInt32(&hits, 0)
+		retryAfterHeader = "X-RateLimit-Reset"
+		retryAfterValue = fmt.Sprintf("%v", time.Now().Unix())
+
+		resp, err := client.Get(server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != 200 {
+			t.Fatalf("expected HTTP 200, got %v", resp.StatusCode)
+		}
+	})
+
+	t.Run("longer than MaxRetryAfter", func(t *testing.T) {
+		atomic.StoreInt32(&hits, 0)
+		retryAfterHeader = "Retry-After"
+		retryAfterValue = "3600"
+
+		timeStart := time.Now()
+		_, err := client.Get(server.URL)
+
+		var retryAfterErr *transport.RetryAfterError
+		if !errors.As(err, &retryAfterErr) {
+			t.Fatalf("expected RetryAfterError, got %v", err)
+		}
+		if retryAfterErr.RetryAfter != time.Hour {
+			t.Fatalf("expected 1h Retry-After, got %v", retryAfterErr.RetryAfter)
+		}
+		if time.Since(timeStart) > time.Second {
+			t.Fatalf("expected to fail fast, but took %v", time.Since(timeStart))
+		}
+	})
+
+	t.Run("longer than default MaxRetryAfter", func(t *testing.T) {
+		atomic.StoreInt32(&hits, 0)
+		retryAfterHeader = "Retry-After"
+		retryAfterValue = "3600"
+
+		client := &http.Client{
+			Transport: transport.Chain(
+				http.DefaultTransport,
+				transport.RetryWithPolicy(transport.RetryPolicy{MaxRetries: 3}),
+			),
+		}
+
+		timeStart := time.Now()
+		_, err := client.Get(server.URL)
+
+		var retryAfterErr *transport.RetryAfterError
+		if !errors.As(err, &retryAfterErr) {
+			t.Fatalf("expected RetryAfterError, got %v", err)
+		}
+		if time.Since(timeStart) > time.Second {
+			t.Fatalf("expected to fail fast, but took %v", time.Since(timeStart))
+		}
+	})
+
+	t.Run("past context deadline", func(t *testing.T) {
+		atomic.StoreInt32(&hits, 0)
+		retryAfterHeader = "RateLimit-Reset"
+		retryAfterValue = "5"
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+
+		req, err := http.NewRequest("GET", server.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = client.Do(req.WithContext(ctx))
+
+		var retryAfterErr *transport.RetryAfterError
+		if !errors.As(err, &retryAfterErr) {
+			t.Fatalf("expected RetryAfterError, got %v", err)
+		}
+	})
+}
+
+func TestRetryBudget(t *testing.T) {
+	var hits int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	client := &http.Client{
+		Transport: transport.Chain(
+			http.DefaultTransport,
+			transport.RetryWithPolicy(transport.RetryPolicy{
+				MaxRetries: 3,
+				MinBackoff: time.Millisecond,
+				Budget:     transport.NewRetryBudget(0.5, 0),
+			}),
+		),
+	}
+
+	for i := 0; i < 10; i++ {
+		resp, err := client.Get(server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+
+	// 10 requests + at most 50% retries. Without the budget, it'd be 40 hits.
+	if got := atomic.LoadInt32(&hits); got > 15 {
+		t.Fatalf("expected at most 15 attempts, got %v", got)
+	}
+}
+
+func TestRetryOnRetryHook(t *testing.T) {
+	var hits int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&hits, 1) < 3 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		fmt.Fprintf(w, "ok")
+	}))
+	defer server.Close()
+
+	var attempts []int
+	client := &http.Client{
+		Transport: transport.Chain(
+			http.DefaultTransport,
+			transport.RetryWithPolicy(transport.RetryPolicy{
+				MaxRetries: 3,
+				MinBackoff: time.Millisecond,
+				OnRetry: func(ctx context.Context, attempt int, req *http.Request, resp *http.Response, err error, wait time.Duration) {
+					if resp.StatusCode != http.StatusBadGateway {
+						t.Errorf("expected HTTP 502 to be retried, got %v", resp.StatusCode)
+					}
+					attempts = append(attempts, attempt)
+					transport.LogRetry(ctx, attempt, req, resp, err, wait)
+				},
+			}),
+		),
+	}
+
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if fmt.Sprint(attempts) != "[1 2]" {
+		t.Fatalf("expected OnRetry to be called for attempts [1 2], got %v", attempts)
+	}
+	if got := transport.RetryAttempts(resp); got != 2 {
+		t.Fatalf("expected 2 retry attempts, got %v", got)
+	}
+
+	resp, err = client.Post(server.URL, "text/plain", strings.NewReader("data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if _, ok := resp.Header[transport.RetryAttemptsHeader]; ok {
+		t.Fatalf("expected no %v header on responses to requests that were not retried", transport.RetryAttemptsHeader)
+	}
+	if got := transport.RetryAttempts(nil); got != 0 {
+		t.Fatalf("expected 0 retry attempts for nil response, got %v", got)
+	}
+}
+
+func TestRetryReusesConnections(t *testing.T) {
+	var hits, conns int32
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&hits, 1) < 4 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintf(w, "%s", strings.Repeat("unavailable", 1000))
+			return
+		}
+		fmt.Fprintf(w, "ok")
+	}))
+	server.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&conns, 1)
+		}
+	}
+	server.Start()
+	defer server.Close()
+
+	baseTransport := &http.Transport{}
+	defer baseTransport.CloseIdleConnections()
+
+	client := &http.Client{
+		Transport: transport.Chain(
+			baseTransport,
+			transport.RetryWithPolicy(transport.RetryPolicy{
+				MaxRetries: 3,
+				MinBackoff: time.Millisecond,
+			}),
+		),
+	}
+
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		t.Fatalf("expected HTTP 200, got %v", resp.StatusCode)
+	}
+	if got := atomic.LoadInt32(&hits); got != 4 {
+		t.Fatalf("expected 4 attempts, got %v", got)
+	}
+	if got := atomic.LoadInt32(&conns); got != 1 {
+		t.Fatalf("expected all attempts to reuse 1 connection, got %v connections", got)
+	}
+}
+
+func TestRetryThroughChain(t *testing.T) {
+	var hits int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "BEARER token" {
+			t.Errorf("expected Authorization header on every attempt")
+		}
+		if atomic.AddInt32(&hits, 1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintf(w, "ok")
+	}))
+	defer server.Close()
+
+	var sent int32
+	countRequests := func(next http.RoundTripper) http.RoundTripper {
+		return transport.RoundTripFunc(func(req *http.Request) (*http.Response, error) {
+			atomic.AddInt32(&sent, 1)
+			return next.RoundTrip(req)
+		})
+	}
+
+	client := &http.Client{
+		Transport: transport.Chain(
+			http.DefaultTransport,
+			transport.RetryWithPolicy(transport.RetryPolicy{
+				MaxRetries: 3,
+				MinBackoff: time.Millisecond,
+			}),
+			transport.SetHeader("Authorization", "BEARER token"),
+			countRequests,
+		),
+	}
+
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		t.Fatalf("expected HTTP 200, got %v", resp.StatusCode)
+	}
+	if got := atomic.LoadInt32(&sent); got != 3 {
+		t.Fatalf("expected all 3 attempts to go through the chain, got %v", got)
+	}
+}
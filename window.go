@@ -0,0 +1,61 @@
+package transport
+
+import "time"
+
+// slidingWindow counts events over the last N bucket widths, e.g. requests
+// and failures in the last 10 seconds. It's not safe for concurrent use.
+type slidingWindow struct {
+	width   time.Duration
+	buckets []windowBucket
+}
+
+type windowBucket struct {
+	epoch  int64 // bucket start, in bucket widths since Unix epoch
+	total  int
+	marked int
+}
+
+func newSlidingWindow(size time.Duration, buckets int) *slidingWindow {
+	if buckets < 1 {
+		buckets = 1
+	}
+	width := size / time.Duration(buckets)
+	if width <= 0 {
+		width = time.Millisecond
+	}
+	return &slidingWindow{
+		width:   width,
+		buckets: make([]windowBucket, buckets),
+	}
+}
+
+// add records total events, out of which marked are of interest
+// (e.g. failures or retries).
+func (w *slidingWindow) add(now time.Time, total, marked int) {
+	epoch := now.UnixNano() / int64(w.width)
+	b := &w.buckets[epoch%int64(len(w.buckets))]
+	if b.epoch != epoch {
+		*b = windowBucket{epoch: epoch}
+	}
+	b.total += total
+	b.marked += marked
+}
+
+// sum returns the event counts within the window.
+func (w *slidingWindow) sum(now time.Time) (total, marked int) {
+	epoch := now.UnixNano() / int64(w.width)
+	for _, b := range w.buckets {
+		if epoch-b.epoch < int64(len(w.buckets)) {
+			total += b.total
+			marked += b.marked
+		}
+	}
+	return total, marked
+}
+
+// reset clears all the counts.
+func (w *slidingWindow) reset() {
+	for i := range w.buckets {
+		w.buckets[i] = windowBucket{}
+	}
+}